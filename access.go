@@ -0,0 +1,82 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// doAccess shows and changes who can do what on the server. Only owners can
+// change it.
+func doAccess() error {
+	action := flag.Arg(1)
+	flags := flag.NewFlagSet("access "+action, flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	if len(flag.Args()) < 2 {
+		usage("Missing access command.")
+	}
+	if err := flags.Parse(flag.Args()[2:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	var req *http.Request
+	var err error
+	switch action {
+	case "list":
+		req, err = http.NewRequest("POST", *target+"/_flexdev/access/list", nil)
+	case "grant":
+		if flags.NArg() != 2 {
+			usage("Want IDENTITY ROLE.")
+		}
+		if err := flexdev.CheckIdentity(flags.Arg(0)); err != nil {
+			return err
+		}
+		if _, err := flexdev.ParseRole(flags.Arg(1)); err != nil {
+			return err
+		}
+		v := url.Values{"identity": {flags.Arg(0)}, "role": {flags.Arg(1)}}
+		req, err = http.NewRequest("POST", *target+"/_flexdev/access/grant?"+v.Encode(), nil)
+	case "revoke":
+		if flags.NArg() != 1 {
+			usage("Want IDENTITY.")
+		}
+		req, err = http.NewRequest("POST", *target+"/_flexdev/access/revoke?"+url.Values{"identity": {flags.Arg(0)}}.Encode(), nil)
+	default:
+		usage("Unknown access command.")
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := doReq(req)
+	if err != nil {
+		return err
+	}
+	if action == "list" {
+		if len(resp.Access) == 0 {
+			fmt.Println("No grants. Everyone the server authenticates is an owner, except App Engine users who aren't admins.")
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, g := range resp.Access {
+			fmt.Fprintf(tw, "%s\t%s\n", g.Identity, g.Role)
+		}
+		tw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// Credentials for flexdev servers that don't use App Engine auth. They must
+// match the server's FLEXDEV_AUTH setting.
+var (
+	authMode       = flag.String("auth", os.Getenv("FLEXDEV_CLIENT_AUTH"), "How to authenticate to the server: google, service-account, token, hmac, mtls or none. By default, whichever credentials are set, or google.")
+	serviceAccount = flag.String("service-account", os.Getenv("FLEXDEV_SERVICE_ACCOUNT"), "JSON key file of a service account to authenticate as, for servers with App Engine auth.")
+	secretFile     = flag.String("secret-file", os.Getenv("FLEXDEV_SECRET_FILE"), "File with the secret to sign requests with, for servers with hmac auth. $FLEXDEV_SECRET also works.")
+	tokenFile      = flag.String("token-file", os.Getenv("FLEXDEV_TOKEN_FILE"), "File with a bearer token, read for each request. $FLEXDEV_TOKEN also works.")
+	tokenCommand   = flag.String("token-command", os.Getenv("FLEXDEV_TOKEN_COMMAND"), "Shell command printing a bearer token, e.g. `gcloud auth print-access-token`.")
+	clientCert     = flag.String("client-cert", os.Getenv("FLEXDEV_CLIENT_CERT"), "PEM client certificate, for servers with mtls auth.")
+	clientKey      = flag.String("client-key", os.Getenv("FLEXDEV_CLIENT_KEY"), "PEM key of -client-cert.")
+	serverCA       = flag.String("ca", os.Getenv("FLEXDEV_CA"), "PEM CA certificate to verify the server with, instead of the system roots.")
+	profileName    = flag.String("profile", os.Getenv("FLEXDEV_PROFILE"), "Named set of the credentials above to use, from $FLEXDEV_PROFILES or ~/.flexdev/profiles.json.")
+)
+
+// A profile is a named set of credentials, e.g. for one server. Its fields
+// are the flags of the same names.
+type profile struct {
+	Auth           string `json:"auth"`
+	ServiceAccount string `json:"service_account"`
+	SecretFile     string `json:"secret_file"`
+	TokenFile      string `json:"token_file"`
+	TokenCommand   string `json:"token_command"`
+	ClientCert     string `json:"client_cert"`
+	ClientKey      string `json:"client_key"`
+	CA             string `json:"ca"`
+}
+
+// usingProfile is set once a profile has replaced the credentials from the
+// environment.
+var usingProfile bool
+
+func profilesPath() string {
+	if p := os.Getenv("FLEXDEV_PROFILES"); p != "" {
+		return p
+	}
+	return filepath.Join(os.Getenv("HOME"), ".flexdev", "profiles.json")
+}
+
+// applyProfile sets the credential flags from -profile, if one is picked.
+// Flags given on the command line win; credentials from the environment are
+// ignored, so that the profile says all there is. Relative paths are relative
+// to the profiles file.
+func applyProfile() error {
+	if *profileName == "" {
+		return nil
+	}
+	path := profilesPath()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read profiles: %v", err)
+	}
+	var profiles map[string]profile
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return fmt.Errorf("Could not read profiles from %s: %v", path, err)
+	}
+	p, ok := profiles[*profileName]
+	if !ok {
+		return fmt.Errorf("No profile %q in %s.", *profileName, path)
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	file := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(filepath.Dir(path), name)
+	}
+	for _, f := range []struct {
+		flag  string
+		value *string
+		to    string
+	}{
+		{"auth", authMode, p.Auth},
+		{"service-account", serviceAccount, file(p.ServiceAccount)},
+		{"secret-file", secretFile, file(p.SecretFile)},
+		{"token-file", tokenFile, file(p.TokenFile)},
+		{"token-command", tokenCommand, p.TokenCommand},
+		{"client-cert", clientCert, file(p.ClientCert)},
+		{"client-key", clientKey, file(p.ClientKey)},
+		{"ca", serverCA, file(p.CA)},
+	} {
+		if !set[f.flag] {
+			*f.value = f.to
+		}
+	}
+	usingProfile = true
+	return nil
+}
+
+const (
+	authGoogle         = "google"
+	authServiceAccount = "service-account"
+	authToken          = "token"
+	authHMAC           = "hmac"
+	authMTLS           = "mtls"
+	authNone           = "none"
+)
+
+var googleScopes = []string{
+	"https://www.googleapis.com/auth/appengine.apis",
+	"https://www.googleapis.com/auth/userinfo.email",
+	"https://www.googleapis.com/auth/cloud.platform",
+}
+
+// A token from -token-command is used for this long before running it again.
+const tokenCommandTTL = 10 * time.Minute
+
+var (
+	clientOnce sync.Once
+	client     *http.Client
+	clientErr  error
+)
+
+// authClient returns the HTTP client to make requests to the server with. It
+// is made once, so credentials are only loaded and exchanged once.
+func authClient() (*http.Client, error) {
+	clientOnce.Do(func() {
+		client, clientErr = newAuthClient()
+	})
+	return client, clientErr
+}
+
+// newAuthClient returns an HTTP client that authenticates to the server as
+// -auth says, or with whichever credentials are set if it is empty.
+func newAuthClient() (*http.Client, error) {
+	if err := applyProfile(); err != nil {
+		return nil, err
+	}
+	transport, err := tlsTransport()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := readSecret()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := bearerTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	mode := *authMode
+	if mode == "" {
+		switch {
+		case len(secret) > 0 && tokens != nil:
+			return nil, errors.New("Both a secret and a token are set. Use one or the other, or pick one with -auth.")
+		case len(secret) > 0:
+			mode = authHMAC
+		case tokens != nil:
+			mode = authToken
+		case *serviceAccount != "":
+			mode = authServiceAccount
+		case *clientCert != "":
+			mode = authMTLS
+		default:
+			mode = authGoogle
+		}
+	}
+
+	ctx := oauth2.NoContext
+	if transport != http.DefaultTransport {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	switch mode {
+	case authNone:
+		return &http.Client{Transport: transport}, nil
+	case authHMAC:
+		if len(secret) == 0 {
+			return nil, errors.New("-auth=hmac needs -secret-file or $FLEXDEV_SECRET.")
+		}
+		return &http.Client{Transport: hmacTransport{secret, transport}}, nil
+	case authToken:
+		if tokens == nil {
+			return nil, errors.New("-auth=token needs -token-file, -token-command or $FLEXDEV_TOKEN.")
+		}
+		return &http.Client{Transport: &oauth2.Transport{Source: tokens, Base: transport}}, nil
+	case authMTLS:
+		if *clientCert == "" {
+			return nil, errors.New("-auth=mtls needs -client-cert.")
+		}
+		return &http.Client{Transport: transport}, nil
+	case authServiceAccount:
+		if *serviceAccount == "" {
+			return nil, errors.New("-auth=service-account needs -service-account.")
+		}
+		b, err := ioutil.ReadFile(*serviceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read service account key: %v", err)
+		}
+		conf, err := google.JWTConfigFromJSON(b, googleScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load service account key %s: %v", *serviceAccount, err)
+		}
+		return oauth2.NewClient(ctx, conf.TokenSource(ctx)), nil
+	case authGoogle:
+		return google.DefaultClient(ctx, googleScopes...)
+	}
+	return nil, fmt.Errorf("Unknown -auth %q. Want google, service-account, token, hmac, mtls or none.", mode)
+}
+
+func readSecret() ([]byte, error) {
+	if *secretFile == "" {
+		if usingProfile {
+			return nil, nil
+		}
+		return []byte(os.Getenv("FLEXDEV_SECRET")), nil
+	}
+	b, err := ioutil.ReadFile(*secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read secret: %v", err)
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+// bearerTokens returns where bearer tokens come from, or nil if none is set.
+func bearerTokens() (oauth2.TokenSource, error) {
+	switch {
+	case *tokenFile != "" && *tokenCommand != "":
+		return nil, errors.New("Both -token-file and -token-command are set. Use one or the other.")
+	case *tokenCommand != "":
+		return oauth2.ReuseTokenSource(nil, commandTokenSource(*tokenCommand)), nil
+	case *tokenFile != "":
+		// Check it now, rather than on the first request.
+		if _, err := fileTokenSource(*tokenFile).Token(); err != nil {
+			return nil, err
+		}
+		return fileTokenSource(*tokenFile), nil
+	case os.Getenv("FLEXDEV_TOKEN") != "" && !usingProfile:
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: os.Getenv("FLEXDEV_TOKEN")}), nil
+	}
+	return nil, nil
+}
+
+// fileTokenSource reads the token from a file each time, so that whatever
+// writes it can rotate it.
+type fileTokenSource string
+
+func (f fileTokenSource) Token() (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read token: %v", err)
+	}
+	t := strings.TrimSpace(string(b))
+	if t == "" {
+		return nil, fmt.Errorf("Token file %s is empty.", f)
+	}
+	return &oauth2.Token{AccessToken: t}, nil
+}
+
+// commandTokenSource runs a shell command and uses what it prints as the
+// token, until tokenCommandTTL has passed.
+type commandTokenSource string
+
+func (c commandTokenSource) Token() (*oauth2.Token, error) {
+	cmd := exec.Command("sh", "-c", string(c))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get token from %q: %v", string(c), err)
+	}
+	t := strings.TrimSpace(string(out))
+	if t == "" {
+		return nil, fmt.Errorf("%q printed no token.", string(c))
+	}
+	return &oauth2.Token{AccessToken: t, Expiry: time.Now().Add(tokenCommandTTL)}, nil
+}
+
+// tlsTransport returns a transport that presents the client certificate and
+// trusts the server CA, if either is set.
+func tlsTransport() (http.RoundTripper, error) {
+	if *clientCert == "" && *serverCA == "" {
+		return http.DefaultTransport, nil
+	}
+	c := &tls.Config{}
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if *serverCA != "" {
+		b, err := ioutil.ReadFile(*serverCA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA: %v", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates in CA %s.", *serverCA)
+		}
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: c}, nil
+}
+
+// hmacTransport signs requests with a shared secret.
+type hmacTransport struct {
+	secret []byte
+	rt     http.RoundTripper
+}
+
+func (t hmacTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	r := cloneRequest(req)
+	r.Body, r.ContentLength = nil, 0
+	if len(body) > 0 {
+		// With a known length, so the server can check it as it reads.
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	if err := flexdev.SignRequest(r, body, t.secret, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.rt.RoundTrip(r)
+}
+
+// cloneRequest returns a copy of req with its own headers, as RoundTrippers
+// must not modify their request.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
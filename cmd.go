@@ -39,9 +39,6 @@ import (
 	"path/filepath"
 	"sync"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-
 	"github.com/broady/flexdev/lib/flexdev"
 	"github.com/termie/go-shutil"
 )
@@ -50,8 +47,24 @@ func main() {
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage:")
 		fmt.Fprintln(os.Stderr, "  flexdev server deploy -project=... -version=... [-module=...]")
-		fmt.Fprintln(os.Stderr, "  flexdev deploy -target=https://...-dot-...-dot-....appspot.com")
-		fmt.Fprintln(os.Stderr, "  flexdev status -target=https://...-dot-...-dot-....appspot.com")
+		fmt.Fprintln(os.Stderr, "  flexdev server run -dir=... -auth=hmac|token|mtls|none [-addr=...] [-tls-cert=... -tls-key=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev dev [-addr=...] [-dir=...] app.yaml")
+		fmt.Fprintln(os.Stderr, "  flexdev deploy -target=https://...-dot-...-dot-....appspot.com [-slot=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev status -target=https://...-dot-...-dot-....appspot.com [-slot=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev start|stop|restart -target=https://...-dot-...-dot-....appspot.com [-slot=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev env set -target=https://... [-slot=...] [-secret] NAME=VALUE...")
+		fmt.Fprintln(os.Stderr, "  flexdev env unset -target=https://... [-slot=...] NAME...")
+		fmt.Fprintln(os.Stderr, "  flexdev env list -target=https://... [-slot=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev requests -target=https://... [-id=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev replay -target=https://... ID")
+		fmt.Fprintln(os.Stderr, "  flexdev shadow start -target=https://... -to=SLOT [-slot=...] [-percent=...] [-all-methods]")
+		fmt.Fprintln(os.Stderr, "  flexdev shadow stop|report -target=https://... [-slot=...] [-v]")
+		fmt.Fprintln(os.Stderr, "  flexdev stats -target=https://... [-slot=...]")
+		fmt.Fprintln(os.Stderr, "  flexdev access list -target=https://...")
+		fmt.Fprintln(os.Stderr, "  flexdev access grant -target=https://... IDENTITY viewer|deployer|owner")
+		fmt.Fprintln(os.Stderr, "  flexdev access revoke -target=https://... IDENTITY")
+		fmt.Fprintln(os.Stderr, "  flexdev history -target=https://... [-n=...] [-since=...] [-action=...] [-identity=...] [-slot=...] [-build=...] [-json]")
+		fmt.Fprintln(os.Stderr, "  flexdev logs -target=https://...-dot-...-dot-....appspot.com [-f] [-n=...] [-since=...] [-stream=...] [-build=...] [-slot=...]")
 		fmt.Fprintln(os.Stderr, "")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -60,10 +73,21 @@ func main() {
 
 	switch flag.Arg(0) {
 	case "server":
-		if flag.Arg(1) != "deploy" {
+		var err error
+		switch flag.Arg(1) {
+		case "deploy":
+			err = doDeployServer()
+		case "run":
+			err = doRunServer()
+		default:
 			usage("Missing command.")
 		}
-		if err := doDeployServer(); err != nil {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "dev":
+		if err := doDev(); err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
@@ -77,6 +101,51 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
+	case "start", "stop", "restart":
+		if err := doApp(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "env":
+		if err := doEnv(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "requests":
+		if err := doRequests(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "replay":
+		if err := doReplay(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "shadow":
+		if err := doShadow(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "stats":
+		if err := doStats(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "access":
+		if err := doAccess(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "history":
+		if err := doHistory(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case "logs":
+		if err := doLogs(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 	default:
 		usage("Missing command.")
 	}
@@ -96,13 +165,37 @@ func doStatus() error {
 		flags.PrintDefaults()
 	}
 	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	slot := flags.String("slot", "", "Slot to show in detail. Defaults to the default slot.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+	req, err := http.NewRequest("POST", *target+"/_flexdev/build/status?"+url.Values{"slot": {*slot}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = doReq(req)
+	return err
+}
+
+// doApp starts, stops or restarts the app on the server, without rebuilding it.
+func doApp(action string) error {
+	flags := flag.NewFlagSet(action, flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	slot := flags.String("slot", "", "Slot of the app. Defaults to the default slot.")
 	if err := flags.Parse(flag.Args()[1:]); err != nil {
 		return err
 	}
 	if *target == "" {
 		usage("Missing 'target' flag.")
 	}
-	req, err := http.NewRequest("POST", *target+"/_flexdev/build/status", nil)
+	req, err := http.NewRequest("POST", *target+"/_flexdev/app/"+action+"?"+url.Values{"slot": {*slot}}.Encode(), nil)
 	if err != nil {
 		return err
 	}
@@ -117,12 +210,19 @@ func doDeploy() error {
 		flags.PrintDefaults()
 	}
 	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	slot := flags.String("slot", "", "Slot to deploy to, e.g. your name or branch. Defaults to the default slot.")
 	if err := flags.Parse(flag.Args()[1:]); err != nil {
 		return err
 	}
 	if *target == "" {
 		usage("Missing 'target' flag.")
 	}
+	if *slot != "" {
+		if err := flexdev.CheckSlotName(*slot); err != nil {
+			return err
+		}
+	}
+	slotQuery := url.Values{"slot": {*slot}}.Encode()
 
 	yamlFile := flags.Arg(0)
 	if yamlFile == "" {
@@ -146,6 +246,30 @@ func doDeploy() error {
 	if err != nil {
 		return fmt.Errorf("Could not get dir list: %v", err)
 	}
+	if dirList, err = dirList.Clean(); err != nil {
+		return fmt.Errorf("Could not deploy %s: %v", appRoot, err)
+	}
+
+	// Check the server's limits before sending anything big.
+	req, err := http.NewRequest("POST", *target+"/_flexdev/build/limits", nil)
+	if err != nil {
+		return err
+	}
+	limitsResp, err := doReq(req)
+	if err != nil {
+		return fmt.Errorf("Could not get upload limits: %v", err)
+	}
+	limits := flexdev.UploadLimits{}
+	if limitsResp.UploadLimits != nil {
+		limits = *limitsResp.UploadLimits
+	}
+	if err := limits.Check(dirList); err != nil {
+		return fmt.Errorf("Could not deploy %s: %v", appRoot, err)
+	}
+	workers := 15
+	if limits.MaxUploads > 0 && limits.MaxUploads < workers {
+		workers = limits.MaxUploads
+	}
 
 	buildReq := &flexdev.CreateBuildRequest{
 		Config: yamlContents,
@@ -156,7 +280,7 @@ func doDeploy() error {
 		return fmt.Errorf("Could not marshal dir list: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", *target+"/_flexdev/build/create", bytes.NewReader(b))
+	req, err = http.NewRequest("POST", *target+"/_flexdev/build/create?"+slotQuery, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -170,7 +294,7 @@ func doDeploy() error {
 	var errMu sync.Mutex
 	var wg sync.WaitGroup
 
-	for i := 0; i < 15; i++ {
+	for i := 0; i < workers; i++ {
 		go func() {
 			for {
 				skip := false
@@ -185,7 +309,7 @@ func doDeploy() error {
 					wg.Done()
 					continue
 				}
-				if err := putFile(resp.Build.ID, *target, filepath.Join(appRoot, path), path); err != nil {
+				if err := putFile(resp.Build.ID, resp.UploadToken, *slot, *target, filepath.Join(appRoot, path), path); err != nil {
 					errMu.Lock()
 					sendErr = fmt.Errorf("Could not send %s: %v", path, err)
 					errMu.Unlock()
@@ -195,8 +319,13 @@ func doDeploy() error {
 		}()
 	}
 
-	for _, destFile := range resp.NeedFiles {
-		fn := filepath.Join(appRoot, destFile)
+	for _, need := range resp.NeedFiles {
+		// Don't let the server ask for files outside the app.
+		destFile, err := flexdev.CleanPath(need)
+		if err != nil {
+			return fmt.Errorf("Server asked for bad path %q: %v", need, err)
+		}
+		fn := filepath.Join(appRoot, filepath.FromSlash(destFile))
 		fi, err := os.Stat(fn)
 		if err != nil {
 			return err
@@ -218,7 +347,7 @@ func doDeploy() error {
 				return err
 			}
 			wg.Add(1)
-			sendFile <- destFile
+			sendFile <- filepath.ToSlash(destFile)
 			return nil
 		})
 		if err != nil {
@@ -234,25 +363,31 @@ func doDeploy() error {
 
 	log.Printf("All files sent.")
 
-	req, err = http.NewRequest("POST", *target+"/_flexdev/build/start", nil)
+	req, err = http.NewRequest("POST", *target+"/_flexdev/build/start?"+slotQuery, nil)
 	if err != nil {
 		return err
 	}
+	req.Header.Set(flexdev.UploadTokenHeader, resp.UploadToken)
 	if _, err := doReq(req); err != nil {
 		log.Print(err)
 	}
 	log.Print("Build successful. App is available at:\n\n")
-	fmt.Fprintf(os.Stderr, "   %s\n\n", *target)
+	if *slot != "" && *slot != flexdev.DefaultSlot {
+		fmt.Fprintf(os.Stderr, "   %s/_slot/%s/\n\n", *target, *slot)
+	} else {
+		fmt.Fprintf(os.Stderr, "   %s\n\n", *target)
+	}
 	return nil
 }
 
-func putFile(buildID, target, filePath, destFile string) error {
+func putFile(buildID, token, slot, target, filePath, destFile string) error {
 	hash, err := flexdev.FileSHA1(filePath)
 	if err != nil {
 		return err
 	}
 	v := url.Values{
 		"id":       {buildID},
+		"slot":     {slot},
 		"filename": {destFile},
 		"sha1":     {hash},
 	}
@@ -266,31 +401,43 @@ func putFile(buildID, target, filePath, destFile string) error {
 	if err != nil {
 		return err
 	}
+	req.Header.Set(flexdev.UploadTokenHeader, token)
 	_, err = doReq(req)
 	return err
 }
 
 func doReq(req *http.Request) (*Response, error) {
-	hc, err := google.DefaultClient(oauth2.NoContext,
-		"https://www.googleapis.com/auth/appengine.apis",
-		"https://www.googleapis.com/auth/userinfo.email",
-		"https://www.googleapis.com/auth/cloud.platform")
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readResponse(resp)
+}
+
+// send performs an authenticated request against a flexdev server.
+func send(req *http.Request) (*http.Response, error) {
+	hc, err := authClient()
 	if err != nil {
 		return nil, err
 	}
 
-	var payload Response
 	resp, err := hc.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Could not perform request: %v", err)
 	}
-	defer resp.Body.Close()
 	if v := resp.Header.Get("X-FlexDev"); v != flexdev.Version {
+		resp.Body.Close()
 		if v == "" {
 			return nil, errors.New("Target doesn't look like a flexdev server. Use `flexdev server deploy` to deploy it.")
 		}
 		return nil, fmt.Errorf("Target should be flexdev version %s. Use `flexdev server deploy` to update it.", flexdev.Version)
 	}
+	return resp, nil
+}
+
+func readResponse(resp *http.Response) (*Response, error) {
+	var payload Response
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("Could not read response body: %v", err)
@@ -301,6 +448,9 @@ func doReq(req *http.Request) (*Response, error) {
 	if payload.Message != "" {
 		log.Printf("Remote message: %s", payload.Message)
 	}
+	for _, p := range payload.BadPaths {
+		log.Printf("Rejected path %q: %s", p.Path, p.Reason)
+	}
 	if payload.Error != "" {
 		return nil, fmt.Errorf("Remote error: %s", payload.Error)
 	}
@@ -312,11 +462,19 @@ type Build struct {
 }
 
 type Response struct {
-	Code      int      `json:"code,omitempty"`
-	Error     string   `json:"error,omitempty"`
-	Build     *Build   `json:"build,omitempty"`
-	NeedFiles []string `json:"need_files,omitempty"`
-	Message   string   `json:"message,omitempty"`
+	Code         int                       `json:"code,omitempty"`
+	Error        string                    `json:"error,omitempty"`
+	Build        *Build                    `json:"build,omitempty"`
+	NeedFiles    []string                  `json:"need_files,omitempty"`
+	BadPaths     flexdev.BadPaths          `json:"bad_paths,omitempty"`
+	UploadToken  string                    `json:"upload_token,omitempty"`
+	Env          []flexdev.EnvVar          `json:"env,omitempty"`
+	Requests     []flexdev.CapturedRequest `json:"requests,omitempty"`
+	Shadow       *flexdev.ShadowReport     `json:"shadow,omitempty"`
+	Access       []flexdev.Grant           `json:"access,omitempty"`
+	History      []flexdev.AuditEvent      `json:"history,omitempty"`
+	UploadLimits *flexdev.UploadLimits     `json:"upload_limits,omitempty"`
+	Message      string                    `json:"message,omitempty"`
 }
 
 func doDeployServer() error {
@@ -344,15 +502,6 @@ func doDeployServer() error {
 	ver := fmt.Sprintf("%s.%s.%s", *project, *module, *version)
 	log.Printf("Deploying to %s", ver)
 
-	pkg, err := build.Import("github.com/broady/flexdev/server", "", build.FindOnly)
-	if err != nil {
-		return fmt.Errorf("could not get server code: %v", err)
-	}
-	libPkg, err := build.Import("github.com/broady/flexdev/lib/flexdev", "", build.FindOnly)
-	if err != nil {
-		return fmt.Errorf("could not get server lib code: %v", err)
-	}
-
 	tmp, err := ioutil.TempDir("", "flexdev-server-")
 	if err != nil {
 		return fmt.Errorf("could not get a temp dir for deployment: %v", err)
@@ -360,12 +509,8 @@ func doDeployServer() error {
 	defer os.RemoveAll(tmp)
 
 	root := filepath.Join(tmp, "flexdev-server")
-
-	if err := shutil.CopyTree(pkg.Dir, root, nil); err != nil {
-		return fmt.Errorf("could not copy %s to %s: %v", pkg.Dir, root, err)
-	}
-	if err := shutil.CopyTree(libPkg.Dir, filepath.Join(root, "vendor", "github.com", "broady", "flexdev", "lib", "flexdev"), nil); err != nil {
-		return fmt.Errorf("could not copy %s to %s: %v", pkg.Dir, root, err)
+	if err := copyServer(root); err != nil {
+		return err
 	}
 
 	f, err := os.OpenFile(filepath.Join(root, "app.yaml"), os.O_APPEND|os.O_WRONLY, 0)
@@ -399,6 +544,25 @@ func doDeployServer() error {
 	return nil
 }
 
+// copyServer copies the server code to root, with the lib vendored.
+func copyServer(root string) error {
+	pkg, err := build.Import("github.com/broady/flexdev/server", "", build.FindOnly)
+	if err != nil {
+		return fmt.Errorf("could not get server code: %v", err)
+	}
+	libPkg, err := build.Import("github.com/broady/flexdev/lib/flexdev", "", build.FindOnly)
+	if err != nil {
+		return fmt.Errorf("could not get server lib code: %v", err)
+	}
+	if err := shutil.CopyTree(pkg.Dir, root, nil); err != nil {
+		return fmt.Errorf("could not copy %s to %s: %v", pkg.Dir, root, err)
+	}
+	if err := shutil.CopyTree(libPkg.Dir, filepath.Join(root, "vendor", "github.com", "broady", "flexdev", "lib", "flexdev"), nil); err != nil {
+		return fmt.Errorf("could not copy %s to %s: %v", pkg.Dir, root, err)
+	}
+	return nil
+}
+
 func writeAppYaml(f *os.File, module string) (err error) {
 	defer func() {
 		closeErr := f.Close()
@@ -0,0 +1,48 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// doDev runs the flexdev server locally with the app configured by the
+// given app.yaml, rebuilding and restarting it whenever its files change.
+// Nothing is uploaded, and no network is needed.
+func doDev() error {
+	flags := flag.NewFlagSet("dev", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", "localhost:8080", "Address to serve the app on.")
+	dir := flags.String("dir", filepath.Join(os.TempDir(), "flexdev-dev"), "Directory to keep builds in.")
+	mode := flags.String("auth", "none", "How the server authenticates requests to its admin API, e.g. from `flexdev status`: hmac, token, mtls or none.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	yamlFile := flags.Arg(0)
+	if yamlFile == "" {
+		usage("Missing 'app.yaml' path.")
+	}
+	fi, err := os.Stat(yamlFile)
+	if err != nil {
+		return fmt.Errorf("Could not stat yaml file: %v", err)
+	}
+	if fi.IsDir() {
+		usage("Config path must be a file, not a directory.")
+	}
+	if yamlFile, err = filepath.Abs(yamlFile); err != nil {
+		return err
+	}
+	if *mode == "appengine" {
+		return errors.New("App Engine auth only works on App Engine.")
+	}
+	return runServer([]string{"-addr", *addr, "-dir", *dir, "-dev", yamlFile}, "FLEXDEV_AUTH="+*mode)
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// doEnv manages environment variables stored on the server, for all slots or
+// for one. They override the config's env_variables, and changing them
+// restarts the apps they apply to.
+func doEnv() error {
+	action := flag.Arg(1)
+	flags := flag.NewFlagSet("env "+action, flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	secret := flags.Bool("secret", false, "Don't show the values when listing. Only for 'env set'.")
+	slot := flags.String("slot", "", "Slot to set or unset variables for, or to list them for. By default, set and unset apply to all slots, and list shows the default slot.")
+	if len(flag.Args()) < 2 {
+		usage("Missing env command.")
+	}
+	if err := flags.Parse(flag.Args()[2:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	var req *http.Request
+	var err error
+	switch action {
+	case "list":
+		req, err = http.NewRequest("POST", *target+"/_flexdev/env/list?"+url.Values{"slot": {*slot}}.Encode(), nil)
+	case "set":
+		if flags.NArg() == 0 {
+			usage("Missing NAME=VALUE.")
+		}
+		var vars []flexdev.EnvVar
+		for _, arg := range flags.Args() {
+			i := strings.Index(arg, "=")
+			if i < 0 {
+				usage(fmt.Sprintf("Want NAME=VALUE, got %q.", arg))
+			}
+			v := flexdev.EnvVar{Name: arg[:i], Value: arg[i+1:], Secret: *secret}
+			if err := flexdev.CheckEnvName(v.Name); err != nil {
+				return err
+			}
+			vars = append(vars, v)
+		}
+		b, err := json.Marshal(vars)
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequest("POST", *target+"/_flexdev/env/set?"+url.Values{"slot": {*slot}}.Encode(), bytes.NewReader(b))
+	case "unset":
+		if flags.NArg() == 0 {
+			usage("Missing NAME.")
+		}
+		req, err = http.NewRequest("POST", *target+"/_flexdev/env/unset?"+url.Values{"name": flags.Args(), "slot": {*slot}}.Encode(), nil)
+	default:
+		usage("Unknown env command.")
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := doReq(req)
+	if err != nil {
+		return err
+	}
+	if action == "list" {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, v := range resp.Env {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", v.Name, v.Value, v.Source)
+		}
+		tw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// doHistory lists the server's audit log: deploys and other changes, and who
+// made them.
+func doHistory() error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	n := flags.Int("n", 50, "Only show the last n events. 0 means all.")
+	since := flags.String("since", "", "Only show events newer than a duration (e.g. 24h) or an RFC 3339 time.")
+	action := flags.String("action", "", "Only show this action, e.g. deploy, app.stop or env.set.")
+	identity := flags.String("identity", "", "Only show events by this identity.")
+	slot := flags.String("slot", "", "Only show events in this slot.")
+	buildID := flags.String("build", "", "Only show events for this build.")
+	asJSON := flags.Bool("json", false, "Print the events as a JSON list.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	v := url.Values{}
+	if *n != 0 {
+		v.Set("n", strconv.Itoa(*n))
+	}
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			return err
+		}
+		v.Set("since", t.Format(time.RFC3339Nano))
+	}
+	for k, f := range map[string]string{"action": *action, "identity": *identity, "slot": *slot, "build": *buildID} {
+		if f != "" {
+			v.Set(k, f)
+		}
+	}
+
+	req, err := http.NewRequest("POST", *target+"/_flexdev/history?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doReq(req)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		events := resp.History
+		if events == nil {
+			events = []flexdev.AuditEvent{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tIDENTITY\tACTION\tSLOT\tBUILD\tOUTCOME\tDETAILS")
+	for _, e := range resp.History {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format("2006-01-02 15:04:05"), e.Identity, e.Action, e.Slot, e.Build, e.Outcome, eventDetails(e))
+	}
+	return tw.Flush()
+}
+
+func eventDetails(e flexdev.AuditEvent) string {
+	if e.Action != "deploy" {
+		return e.Details
+	}
+	d := []string{fmt.Sprintf("tree %.12s", e.TreeHash), fmt.Sprintf("+%d -%d", len(e.Added), len(e.Removed))}
+	for _, p := range []string{"upload", "build", "start"} {
+		if s, ok := e.Phases[p]; ok {
+			d = append(d, fmt.Sprintf("%s %v", p, time.Duration(s*float64(time.Second)).Round(time.Millisecond)))
+		}
+	}
+	return strings.Join(d, ", ")
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+// Role is what an identity may do on the flexdev server. Each role can do
+// everything the ones before it can.
+type Role string
+
+const (
+	// RoleViewer can read status, logs, env, captured requests and metrics.
+	RoleViewer = Role("viewer")
+	// RoleDeployer can also deploy, start, stop and restart apps, change env
+	// and replay or shadow requests.
+	RoleDeployer = Role("deployer")
+	// RoleOwner can also change the access policy.
+	RoleOwner = Role("owner")
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleDeployer: 2, RoleOwner: 3}
+
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if roleRank[r] == 0 {
+		return "", fmt.Errorf("Unknown role %q. Want %s, %s or %s.", s, RoleViewer, RoleDeployer, RoleOwner)
+	}
+	return r, nil
+}
+
+// Allows reports whether r can do what needs role need.
+func (r Role) Allows(need Role) bool {
+	return roleRank[r] > 0 && roleRank[r] >= roleRank[need]
+}
+
+// AnyIdentity in a policy matches every authenticated identity without a
+// grant of its own.
+const AnyIdentity = "*"
+
+// Grant gives an identity a role.
+type Grant struct {
+	Identity string `json:"identity"`
+	Role     Role   `json:"role"`
+}
+
+// Policy maps identities to their roles.
+type Policy map[string]Role
+
+// RoleOf returns the role of identity, if it has one.
+func (p Policy) RoleOf(identity string) (Role, bool) {
+	if r, ok := p[identity]; ok {
+		return r, true
+	}
+	r, ok := p[AnyIdentity]
+	return r, ok
+}
+
+// Grants returns the policy as a list sorted by identity.
+func (p Policy) Grants() []Grant {
+	g := make([]Grant, 0, len(p))
+	for id, r := range p {
+		g = append(g, Grant{id, r})
+	}
+	sort.Slice(g, func(i, j int) bool { return g[i].Identity < g[j].Identity })
+	return g
+}
+
+func CheckIdentity(identity string) error {
+	if identity == "" {
+		return errors.New("Empty identity.")
+	}
+	for _, c := range identity {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return fmt.Errorf("Bad identity %q.", identity)
+		}
+	}
+	return nil
+}
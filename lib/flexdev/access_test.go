@@ -0,0 +1,47 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import "testing"
+
+func TestRoleAllows(t *testing.T) {
+	for _, tt := range []struct {
+		r, need Role
+		want    bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleDeployer, false},
+		{RoleDeployer, RoleViewer, true},
+		{RoleDeployer, RoleOwner, false},
+		{RoleOwner, RoleDeployer, true},
+		{RoleOwner, RoleOwner, true},
+		{Role(""), RoleViewer, false},
+		{Role("admin"), RoleViewer, false},
+	} {
+		if got := tt.r.Allows(tt.need); got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.r, tt.need, got, tt.want)
+		}
+	}
+	if _, err := ParseRole("admin"); err == nil {
+		t.Error("ParseRole(admin) succeeded, want error")
+	}
+}
+
+func TestPolicyRoleOf(t *testing.T) {
+	p := Policy{"alice@example.com": RoleOwner, "qa": RoleViewer}
+	if r, ok := p.RoleOf("alice@example.com"); !ok || r != RoleOwner {
+		t.Errorf("RoleOf(alice) = %q, %v", r, ok)
+	}
+	if r, ok := p.RoleOf("bob@example.com"); ok {
+		t.Errorf("RoleOf(bob) = %q, want no role", r)
+	}
+	p[AnyIdentity] = RoleViewer
+	if r, ok := p.RoleOf("bob@example.com"); !ok || r != RoleViewer {
+		t.Errorf("RoleOf(bob) with %s = %q, %v; want viewer", AnyIdentity, r, ok)
+	}
+	if want, got := "alice@example.com", p.Grants()[1].Identity; want != got {
+		t.Errorf("Grants()[1] = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// AuditEvent is an entry in the server's audit log: a deploy, or another
+// change made through the admin API.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Action   string    `json:"action"` // e.g. "deploy", "app.stop", "env.set".
+	Slot     string    `json:"slot,omitempty"`
+	Build    string    `json:"build,omitempty"`
+	Outcome  string    `json:"outcome"` // "ok", or what went wrong.
+
+	// Deploys only.
+	TreeHash string             `json:"tree_hash,omitempty"`
+	Added    []string           `json:"added,omitempty"`
+	Removed  []string           `json:"removed,omitempty"`
+	Phases   map[string]float64 `json:"phases,omitempty"` // Seconds spent in upload, build and start.
+
+	// Details of other actions, e.g. the names of env variables set. Never
+	// secret values.
+	Details string `json:"details,omitempty"`
+}
+
+// AuditQuery selects events from the audit log. Zero fields match everything.
+type AuditQuery struct {
+	Since    time.Time
+	Action   string
+	Identity string
+	Slot     string
+	Build    string
+	Limit    int // Only the last Limit matching events.
+}
+
+func (q AuditQuery) match(e AuditEvent) bool {
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Action == "" || q.Action == e.Action) &&
+		(q.Identity == "" || q.Identity == e.Identity) &&
+		(q.Slot == "" || q.Slot == e.Slot) &&
+		(q.Build == "" || q.Build == e.Build)
+}
+
+// ReadAudit returns the events matching q in r, a log with one JSON event
+// per line, oldest first.
+func ReadAudit(r io.Reader, q AuditQuery) ([]AuditEvent, error) {
+	var events []AuditEvent
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !q.match(e) {
+			continue
+		}
+		events = append(events, e)
+		if q.Limit > 0 && len(events) > 2*q.Limit {
+			events = append(events[:0], events[len(events)-q.Limit:]...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
+
+// TreeHash returns a hash of the paths and contents of the files in d, which
+// identifies the tree a build was made from.
+func (d DirList) TreeHash() string {
+	files := make(DirList, 0, len(d))
+	for _, e := range d {
+		if !e.IsDir {
+			files = append(files, e)
+		}
+	}
+	sort.Sort(files)
+	h := sha1.New()
+	for _, e := range files {
+		fmt.Fprintf(h, "%s\x00%s\n", e.Path, e.SHA1)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
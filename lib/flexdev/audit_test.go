@@ -0,0 +1,76 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAudit(t *testing.T) {
+	t0 := time.Date(2016, 5, 6, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	for i, e := range []AuditEvent{
+		{Identity: "alice", Action: "deploy", Slot: "default", Build: "1"},
+		{Identity: "bob", Action: "deploy", Slot: "bob", Build: "2"},
+		{Identity: "alice", Action: "app.stop", Slot: "default", Build: "1"},
+		{Identity: "alice", Action: "deploy", Slot: "default", Build: "3"},
+	} {
+		e.Time = t0.Add(time.Duration(i) * time.Hour)
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(b, '\n'))
+	}
+
+	builds := func(q AuditQuery) string {
+		events, err := ReadAudit(bytes.NewReader(buf.Bytes()), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.Build)
+		}
+		return strings.Join(ids, ",")
+	}
+	for _, tt := range []struct {
+		q    AuditQuery
+		want string
+	}{
+		{AuditQuery{}, "1,2,1,3"},
+		{AuditQuery{Action: "deploy"}, "1,2,3"},
+		{AuditQuery{Identity: "alice", Action: "deploy"}, "1,3"},
+		{AuditQuery{Slot: "bob"}, "2"},
+		{AuditQuery{Build: "1"}, "1,1"},
+		{AuditQuery{Since: t0.Add(2 * time.Hour)}, "1,3"},
+		{AuditQuery{Limit: 2}, "1,3"},
+		{AuditQuery{Action: "deploy", Limit: 1}, "3"},
+	} {
+		if got := builds(tt.q); got != tt.want {
+			t.Errorf("ReadAudit(%+v) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+
+	if _, err := ReadAudit(strings.NewReader("{}\nnot json\n"), AuditQuery{}); err == nil {
+		t.Error("ReadAudit of a bad line succeeded, want error")
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	a := DirList{{Path: ".", IsDir: true}, {Path: "a.go", SHA1: "1"}, {Path: "b", IsDir: true}, {Path: "b/c.go", SHA1: "2"}}
+	b := DirList{{Path: "b/c.go", SHA1: "2"}, {Path: "a.go", SHA1: "1"}}
+	if a.TreeHash() != b.TreeHash() {
+		t.Errorf("TreeHash depends on order or directories")
+	}
+	c := DirList{{Path: "a.go", SHA1: "1"}, {Path: "b/c.go", SHA1: "3"}}
+	if a.TreeHash() == c.TreeHash() {
+		t.Errorf("TreeHash ignores contents")
+	}
+}
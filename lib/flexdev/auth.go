@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HMACScheme is the Authorization scheme of requests signed with a secret
+// shared by the client and the server.
+const HMACScheme = "Flexdev-HMAC"
+
+// MaxClockSkew is how far the time a request was signed at may be from the
+// server's clock.
+const MaxClockSkew = 5 * time.Minute
+
+// ContentHashHeader carries the hex SHA-256 of a signed request's body, so
+// the signature can be checked before the body is read.
+const ContentHashHeader = "X-Flexdev-Content-Sha256"
+
+// SignRequest signs r, whose body is body, with secret as of t. It sets r's
+// Authorization and ContentHashHeader headers. Each signature has a random
+// nonce, so that the server can refuse to see it twice.
+func SignRequest(r *http.Request, body, secret []byte, t time.Time) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("could not make a nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(b)
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	ts := strconv.FormatInt(t.Unix(), 10)
+	r.Header.Set(ContentHashHeader, digest)
+	r.Header.Set("Authorization", fmt.Sprintf("%s t=%s, nonce=%s, sig=%s", HMACScheme, ts, nonce, signature(r, digest, secret, ts, nonce)))
+	return nil
+}
+
+// A Signature is a verified request signature.
+type Signature struct {
+	Time  time.Time
+	Nonce string
+}
+
+// VerifyRequest checks that r was signed with secret within MaxClockSkew of
+// now. It does not read the body: the signature covers the hash in
+// ContentHashHeader, which VerifyBody checks the body against.
+func VerifyRequest(r *http.Request, secret []byte, now time.Time) (Signature, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, HMACScheme+" ") {
+		return Signature{}, fmt.Errorf("request is not signed with %s", HMACScheme)
+	}
+	var ts, nonce, sig string
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, HMACScheme+" "), ",") {
+		kv = strings.TrimSpace(kv)
+		switch {
+		case strings.HasPrefix(kv, "t="):
+			ts = strings.TrimPrefix(kv, "t=")
+		case strings.HasPrefix(kv, "nonce="):
+			nonce = strings.TrimPrefix(kv, "nonce=")
+		case strings.HasPrefix(kv, "sig="):
+			sig = strings.TrimPrefix(kv, "sig=")
+		}
+	}
+	digest := r.Header.Get(ContentHashHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || nonce == "" || sig == "" || digest == "" {
+		return Signature{}, errors.New("malformed signature")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > MaxClockSkew || d < -MaxClockSkew {
+		return Signature{}, fmt.Errorf("signature time is %v off; check the clocks", d.Round(time.Second))
+	}
+	want := signature(r, digest, secret, ts, nonce)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return Signature{}, errors.New("bad signature")
+	}
+	return Signature{Time: time.Unix(sec, 0), Nonce: nonce}, nil
+}
+
+// VerifyBody replaces r's body with one that hashes it as it is read, and
+// fails if it does not match the hash in ContentHashHeader. If r's length is
+// known, the last bytes of a body that doesn't match are never returned.
+func VerifyBody(r *http.Request) {
+	body := r.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	r.Body = &hashedBody{
+		ReadCloser: body,
+		hash:       sha256.New(),
+		want:       r.Header.Get(ContentHashHeader),
+		left:       r.ContentLength,
+	}
+}
+
+type hashedBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+	left int64 // Bytes until the end, or -1 if unknown.
+	err  error
+}
+
+var errBodyHash = errors.New("body does not match its signed hash")
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.left >= 0 && int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if b.left >= 0 {
+		b.left -= int64(n)
+	}
+	if b.left == 0 || err == io.EOF {
+		if hex.EncodeToString(b.hash.Sum(nil)) != b.want {
+			b.err = errBodyHash
+			return 0, b.err
+		}
+		if b.left == 0 {
+			err = io.EOF
+		}
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// signature covers the method, path and query, time, nonce and body hash of
+// r.
+func signature(r *http.Request, digest string, secret []byte, ts, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), ts, nonce, digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Unix(1500000000, 0)
+	body := []byte(`{"config":"x"}`)
+
+	sign := func() *http.Request {
+		r, err := http.NewRequest("POST", "https://flexdev.example.com/_flexdev/build/create?slot=alice", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SignRequest(r, body, secret, now); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	sig, err := VerifyRequest(sign(), secret, now.Add(time.Minute))
+	if err != nil {
+		t.Errorf("VerifyRequest: %v", err)
+	}
+	if !sig.Time.Equal(now) || sig.Nonce == "" {
+		t.Errorf("VerifyRequest = %+v, want time %v and a nonce", sig, now)
+	}
+	if other, _ := VerifyRequest(sign(), secret, now); other.Nonce == sig.Nonce {
+		t.Errorf("two signatures with nonce %s", sig.Nonce)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(r *http.Request) ([]byte, time.Time)
+	}{
+		{"other secret", func(r *http.Request) ([]byte, time.Time) { return []byte("guess"), now }},
+		{"other body hash", func(r *http.Request) ([]byte, time.Time) {
+			r.Header.Set(ContentHashHeader, "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a")
+			return secret, now
+		}},
+		{"no body hash", func(r *http.Request) ([]byte, time.Time) {
+			r.Header.Del(ContentHashHeader)
+			return secret, now
+		}},
+		{"other query", func(r *http.Request) ([]byte, time.Time) {
+			r.URL.RawQuery = "slot=bob"
+			return secret, now
+		}},
+		{"other method", func(r *http.Request) ([]byte, time.Time) {
+			r.Method = "GET"
+			return secret, now
+		}},
+		{"too late", func(r *http.Request) ([]byte, time.Time) {
+			return secret, now.Add(MaxClockSkew + time.Second)
+		}},
+		{"too early", func(r *http.Request) ([]byte, time.Time) {
+			return secret, now.Add(-MaxClockSkew - time.Second)
+		}},
+		{"bearer", func(r *http.Request) ([]byte, time.Time) {
+			r.Header.Set("Authorization", "Bearer x")
+			return secret, now
+		}},
+		{"malformed", func(r *http.Request) ([]byte, time.Time) {
+			r.Header.Set("Authorization", HMACScheme+" sig=abc")
+			return secret, now
+		}},
+	} {
+		r := sign()
+		s, at := tt.change(r)
+		if _, err := VerifyRequest(r, s, at); err == nil {
+			t.Errorf("%s: VerifyRequest succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	body := []byte(`{"config":"x"}`)
+	for _, tt := range []struct {
+		name    string
+		body    []byte
+		length  int64
+		wantErr bool
+	}{
+		{"same", body, int64(len(body)), false},
+		{"same, unknown length", body, -1, false},
+		{"other", []byte(`{"config":"y"}`), int64(len(body)), true},
+		{"other, unknown length", []byte(`{"config":"y"}`), -1, true},
+		{"empty", nil, 0, true},
+	} {
+		r, err := http.NewRequest("POST", "https://flexdev.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SignRequest(r, body, []byte("s3cret"), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		r.Body, r.ContentLength = ioutil.NopCloser(bytes.NewReader(tt.body)), tt.length
+		VerifyBody(r)
+		got, err := ioutil.ReadAll(r.Body)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: read %q, want error", tt.name, got)
+			}
+			if tt.length >= 0 && len(got) == len(body) {
+				t.Errorf("%s: read the whole body before failing", tt.name)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%s: read %q, %v; want %q", tt.name, got, err, body)
+		}
+	}
+}
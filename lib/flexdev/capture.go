@@ -0,0 +1,36 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"net/http"
+	"time"
+)
+
+// CapturedRequest is a request that went through the proxy, and the app's
+// response to it. Bodies are truncated to the configured size.
+type CapturedRequest struct {
+	ID       string        `json:"id"`
+	ReplayOf string        `json:"replay_of,omitempty"`
+	Slot     string        `json:"slot,omitempty"`
+	Build    string        `json:"build"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Host          string      `json:"host"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+
+	Status                int         `json:"status"`
+	ResponseHeader        http.Header `json:"response_header"`
+	ResponseBody          []byte      `json:"response_body,omitempty"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated,omitempty"`
+}
+
+// ReplayHeader is set on replayed requests to the ID of the original request.
+const ReplayHeader = "X-Flexdev-Replay"
@@ -0,0 +1,35 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EnvVar is an environment variable set for the app.
+type EnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"`
+
+	// Source is "app.yaml" for env_variables from the uploaded config, or
+	// "server" for variables set with `flexdev env set`.
+	Source string `json:"source,omitempty"`
+}
+
+// Redacted is shown in place of secret values.
+const Redacted = "<redacted>"
+
+func CheckEnvName(name string) error {
+	if name == "" {
+		return errors.New("Empty environment variable name.")
+	}
+	if strings.ContainsAny(name, "=\x00") {
+		return fmt.Errorf("Bad environment variable name %q.", name)
+	}
+	return nil
+}
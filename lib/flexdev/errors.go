@@ -0,0 +1,44 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CompileError is an error reported by the Go tools for a source position.
+type CompileError struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Col  int    `json:"col,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+var compileErrorRE = regexp.MustCompile(`^(\S+\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// ParseCompileErrors extracts the positioned errors from the output of
+// `go build` or `go install`. Other lines are ignored, except for indented
+// continuation lines, which are appended to the previous error.
+func ParseCompileErrors(out string) []CompileError {
+	var errs []CompileError
+	for _, line := range strings.Split(out, "\n") {
+		m := compileErrorRE.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			if len(errs) != 0 && strings.HasPrefix(line, "\t") {
+				errs[len(errs)-1].Msg += "\n" + strings.TrimSpace(line)
+			}
+			continue
+		}
+		e := CompileError{File: strings.TrimPrefix(m[1], "./"), Msg: m[4]}
+		e.Line, _ = strconv.Atoi(m[2])
+		if m[3] != "" {
+			e.Col, _ = strconv.Atoi(m[3])
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
@@ -0,0 +1,36 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCompileErrors(t *testing.T) {
+	out := `# _/tmp/flexdev-server
+./main.go:3:14: undefined: foo
+./main.go:9:2: cannot use x (type int) as type string in return argument
+	have int
+lib/util.go:12: syntax error: unexpected }
+/abs/path/x.go:1:1: expected 'package', found 'EOF'
+exit status 2
+`
+	want := []CompileError{
+		{File: "main.go", Line: 3, Col: 14, Msg: "undefined: foo"},
+		{File: "main.go", Line: 9, Col: 2, Msg: "cannot use x (type int) as type string in return argument\nhave int"},
+		{File: "lib/util.go", Line: 12, Msg: "syntax error: unexpected }"},
+		{File: "/abs/path/x.go", Line: 1, Col: 1, Msg: "expected 'package', found 'EOF'"},
+	}
+	if got := ParseCompileErrors(out); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseCompileErrors:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseCompileErrorsNone(t *testing.T) {
+	if got := ParseCompileErrors("can't load package: package .: no Go files\n"); len(got) != 0 {
+		t.Fatalf("want no errors, got %+v", got)
+	}
+}
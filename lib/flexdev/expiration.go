@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var expirationUnits = map[byte]time.Duration{
+	'd': 24 * time.Hour,
+	'h': time.Hour,
+	'm': time.Minute,
+	's': time.Second,
+}
+
+// ParseExpiration parses an app.yaml expiration, such as "4d 5h" or "30m":
+// space-separated numbers, each followed by d, h, m or s.
+func ParseExpiration(s string) (time.Duration, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid expiration %q", s)
+	}
+	var d time.Duration
+	for _, f := range fields {
+		unit, ok := expirationUnits[f[len(f)-1]]
+		if !ok {
+			return 0, fmt.Errorf("invalid expiration %q: unknown unit in %q", s, f)
+		}
+		n, err := strconv.ParseInt(f[:len(f)-1], 10, 32)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid expiration %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
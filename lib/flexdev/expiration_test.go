@@ -0,0 +1,34 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiration(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"0s":          0,
+		"30m":         30 * time.Minute,
+		"4d 5h":       4*24*time.Hour + 5*time.Hour,
+		" 1d  1s ":    24*time.Hour + time.Second,
+		"1h 1m 1s 1d": 25*time.Hour + time.Minute + time.Second,
+	} {
+		got, err := ParseExpiration(in)
+		if err != nil {
+			t.Errorf("ParseExpiration(%q): %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseExpiration(%q) = %v, want %v", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "5", "d", "5w", "-1d", "1.5h", "99999999999d"} {
+		if _, err := ParseExpiration(in); err == nil {
+			t.Errorf("ParseExpiration(%q) succeeded, want error", in)
+		}
+	}
+}
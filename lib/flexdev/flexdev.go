@@ -29,6 +29,8 @@ const (
 	StateFetching = state("fetching")
 	StateBuilding = state("building")
 	StateBuilt    = state("built")
+	StateStarting = state("starting")
+	StateFailed   = state("failed")
 	StateRunning  = state("running")
 	StateStopped  = state("stopped")
 )
@@ -51,6 +53,7 @@ type DirEntry struct {
 	Path  string
 	IsDir bool
 	SHA1  string
+	Size  int64
 }
 
 func (e DirEntry) InDir(dir DirEntry) bool {
@@ -80,11 +83,15 @@ func ListDir(dirPath string) (DirList, error) {
 		if p, err := filepath.Rel(dirPath, path); err != nil {
 			return err
 		} else {
-			e.Path = p
+			e.Path = filepath.ToSlash(p)
 		}
 		if fi == nil {
 			return fmt.Errorf("fi nil: %s", path)
 		}
+		// Sockets, pipes and devices can't be read like files, or deployed.
+		if fi.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0 {
+			return nil
+		}
 		e.IsDir = fi.IsDir()
 		if !fi.IsDir() {
 			sha, err := FileSHA1(path)
@@ -92,6 +99,7 @@ func ListDir(dirPath string) (DirList, error) {
 				return err
 			}
 			e.SHA1 = sha
+			e.Size = fi.Size()
 		}
 		d = append(d, e)
 		return nil
@@ -4,7 +4,14 @@
 
 package flexdev
 
-import "testing"
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestTwoFiles(t *testing.T) {
 	ours := DirList{
@@ -107,3 +114,31 @@ func TestInDir(t *testing.T) {
 		t.Error("a/b was not in dir a")
 	}
 }
+
+func TestListDirSkipsSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "app.sock"))
+	if err != nil {
+		t.Skipf("No unix sockets: %v", err)
+	}
+	defer l.Close()
+
+	d, err := ListDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range d {
+		paths = append(paths, e.Path)
+	}
+	if want, got := ".,main.go", strings.Join(paths, ","); want != got {
+		t.Errorf("want paths %s, got %s", want, got)
+	}
+}
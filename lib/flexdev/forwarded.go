@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"net"
+	"strings"
+)
+
+// Forwarded is one element of an RFC 7239 Forwarded header: one hop of a
+// proxied request. Empty fields are omitted.
+type Forwarded struct {
+	For   string // Client address, with or without a port.
+	By    string // Proxy address.
+	Host  string
+	Proto string
+}
+
+func (f Forwarded) String() string {
+	var pairs []string
+	add := func(k, v string) {
+		if v != "" {
+			pairs = append(pairs, k+"="+forwardedValue(v))
+		}
+	}
+	add("for", forwardedNode(f.For))
+	add("by", forwardedNode(f.By))
+	add("host", f.Host)
+	add("proto", f.Proto)
+	return strings.Join(pairs, ";")
+}
+
+// forwardedNode brackets IPv6 addresses, as RFC 7239 requires.
+func forwardedNode(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		return host + ":" + port
+	}
+	return host
+}
+
+// forwardedValue quotes v unless it is a plain token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// FormatForwarded formats hops as the value of a Forwarded header.
+func FormatForwarded(hops []Forwarded) string {
+	s := make([]string, len(hops))
+	for i, h := range hops {
+		s[i] = h.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// ParseForwarded parses the value of a Forwarded header. Unknown parameters
+// and malformed pairs are skipped.
+func ParseForwarded(v string) []Forwarded {
+	var hops []Forwarded
+	for _, elem := range splitQuoted(v, ',') {
+		var f Forwarded
+		for _, pair := range splitQuoted(elem, ';') {
+			i := strings.Index(pair, "=")
+			if i < 0 {
+				continue
+			}
+			val := strings.TrimSpace(pair[i+1:])
+			if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+				val = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(val[1 : len(val)-1])
+			}
+			switch strings.ToLower(strings.TrimSpace(pair[:i])) {
+			case "for":
+				f.For = val
+			case "by":
+				f.By = val
+			case "host":
+				f.Host = val
+			case "proto":
+				f.Proto = val
+			}
+		}
+		hops = append(hops, f)
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep, except inside quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import "testing"
+
+func TestFormatForwarded(t *testing.T) {
+	for _, tt := range []struct {
+		hops []Forwarded
+		want string
+	}{
+		{[]Forwarded{{For: "192.0.2.60", Proto: "https", Host: "example.com"}}, "for=192.0.2.60;host=example.com;proto=https"},
+		{[]Forwarded{{For: "192.0.2.60:4711"}}, `for="192.0.2.60:4711"`},
+		{[]Forwarded{{For: "2001:db8::1"}}, `for="[2001:db8::1]"`},
+		{[]Forwarded{{For: "[2001:db8::1]:4711"}}, `for="[2001:db8::1]:4711"`},
+		{[]Forwarded{{For: "unknown"}, {For: "10.0.0.1", By: "10.0.0.2"}}, "for=unknown, for=10.0.0.1;by=10.0.0.2"},
+		{[]Forwarded{{Host: `a"b`}}, `host="a\"b"`},
+		{[]Forwarded{{}}, ""},
+	} {
+		if got := FormatForwarded(tt.hops); got != tt.want {
+			t.Errorf("FormatForwarded(%+v) = %s, want %s", tt.hops, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	got := ParseForwarded(`for=192.0.2.43;proto=https;HOST="a.example, b";x=y, for="[2001:db8::1]:80";by=unknown`)
+	want := []Forwarded{
+		{For: "192.0.2.43", Host: "a.example, b", Proto: "https"},
+		{For: "[2001:db8::1]:80", By: "unknown"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d hops, got %+v", len(want), got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("hop %d: want %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
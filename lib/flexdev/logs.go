@@ -0,0 +1,229 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stream identifies where a log line came from.
+type Stream string
+
+const (
+	StreamStdout     = Stream("stdout")
+	StreamStderr     = Stream("stderr")
+	StreamBuild      = Stream("build")
+	StreamSupervisor = Stream("supervisor")
+)
+
+// ParseStream parses a stream name, as used by the logs endpoint.
+func ParseStream(s string) (Stream, error) {
+	switch st := Stream(strings.TrimSpace(s)); st {
+	case StreamStdout, StreamStderr, StreamBuild, StreamSupervisor:
+		return st, nil
+	}
+	return "", fmt.Errorf("Unknown stream %q. Want one of %s, %s, %s or %s.", s, StreamStdout, StreamStderr, StreamBuild, StreamSupervisor)
+}
+
+// LogContentType is the content type of a stream of JSON-encoded LogLines.
+const LogContentType = "application/x-ndjson"
+
+const (
+	DefaultLogLines = 10000
+	DefaultLogSize  = 4 << 20
+
+	// Longer lines are split.
+	maxLineLen = 16 << 10
+)
+
+type LogLine struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream Stream    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// LogQuery selects lines from a LogBuffer. Zero fields match everything.
+type LogQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Streams  []Stream
+	AfterSeq int64 // Only lines with a greater sequence number.
+	Limit    int   // Only the last Limit matching lines.
+}
+
+func (q LogQuery) match(l LogLine) bool {
+	if l.Seq <= q.AfterSeq {
+		return false
+	}
+	if !q.Since.IsZero() && l.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && l.Time.After(q.Until) {
+		return false
+	}
+	if len(q.Streams) == 0 {
+		return true
+	}
+	for _, s := range q.Streams {
+		if s == l.Stream {
+			return true
+		}
+	}
+	return false
+}
+
+// LogBuffer is a bounded, thread-safe ring of log lines. Once it holds more
+// than maxLines lines or maxBytes bytes of text, the oldest lines are dropped.
+type LogBuffer struct {
+	mu       sync.Mutex
+	ring     []LogLine
+	head     int // Index of the oldest line.
+	n        int
+	bytes    int
+	maxBytes int
+	seq      int64
+	partial  map[Stream][]byte
+	changed  chan struct{}
+}
+
+func NewLogBuffer(maxLines, maxBytes int) *LogBuffer {
+	if maxLines <= 0 {
+		maxLines = DefaultLogLines
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultLogSize
+	}
+	return &LogBuffer{
+		ring:     make([]LogLine, maxLines),
+		maxBytes: maxBytes,
+		partial:  make(map[Stream][]byte),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Add appends a single line.
+func (b *LogBuffer) Add(s Stream, text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(s, text)
+	b.notify()
+}
+
+func (b *LogBuffer) Printf(s Stream, format string, args ...interface{}) {
+	b.Add(s, fmt.Sprintf(format, args...))
+}
+
+func (b *LogBuffer) add(s Stream, text string) {
+	for len(text) > maxLineLen {
+		b.add(s, text[:maxLineLen])
+		text = text[maxLineLen:]
+	}
+	for b.n > 0 && (b.n == len(b.ring) || b.bytes+len(text) > b.maxBytes) {
+		b.bytes -= len(b.ring[b.head].Text)
+		b.ring[b.head] = LogLine{}
+		b.head = (b.head + 1) % len(b.ring)
+		b.n--
+	}
+	b.seq++
+	b.ring[(b.head+b.n)%len(b.ring)] = LogLine{
+		Seq:    b.seq,
+		Time:   time.Now(),
+		Stream: s,
+		Text:   text,
+	}
+	b.n++
+	b.bytes += len(text)
+}
+
+func (b *LogBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Writer returns a writer that adds each line written to it to the buffer.
+// Incomplete lines are held until they are terminated or Flush is called.
+func (b *LogBuffer) Writer(s Stream) io.Writer {
+	return streamWriter{b, s}
+}
+
+type streamWriter struct {
+	b *LogBuffer
+	s Stream
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+
+	buf := append(w.b.partial[w.s], p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.b.add(w.s, string(bytes.TrimSuffix(buf[:i], []byte("\r"))))
+		buf = buf[i+1:]
+	}
+	if len(buf) >= maxLineLen {
+		w.b.add(w.s, string(buf))
+		buf = nil
+	}
+	w.b.partial[w.s] = append([]byte(nil), buf...)
+	w.b.notify()
+	return len(p), nil
+}
+
+// Flush adds any incomplete lines written to the buffer's writers.
+func (b *LogBuffer) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s, p := range b.partial {
+		if len(p) != 0 {
+			b.add(s, string(p))
+		}
+		delete(b.partial, s)
+	}
+	b.notify()
+}
+
+// Query returns the lines matching q, oldest first.
+func (b *LogBuffer) Query(q LogQuery) []LogLine {
+	lines, _ := b.Wait(q)
+	return lines
+}
+
+// Wait is like Query, but also returns a channel that is closed when lines are
+// next added to the buffer.
+func (b *LogBuffer) Wait(q LogQuery) ([]LogLine, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []LogLine
+	for i := 0; i < b.n; i++ {
+		l := b.ring[(b.head+i)%len(b.ring)]
+		if q.match(l) {
+			lines = append(lines, l)
+		}
+	}
+	if q.Limit > 0 && len(lines) > q.Limit {
+		lines = lines[len(lines)-q.Limit:]
+	}
+	return lines, b.changed
+}
+
+// String returns the text of all lines matching q, one per line.
+func (b *LogBuffer) String(q LogQuery) string {
+	buf := &bytes.Buffer{}
+	for _, l := range b.Query(q) {
+		buf.WriteString(l.Text)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
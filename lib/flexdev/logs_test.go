@@ -0,0 +1,140 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogWriterSplitsLines(t *testing.T) {
+	b := NewLogBuffer(0, 0)
+	w := b.Writer(StreamStdout)
+	fmt.Fprint(w, "a\nb")
+	fmt.Fprint(w, "c\r\nd")
+	if want, got := "a\nbc\n", b.String(LogQuery{}); want != got {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	b.Flush()
+	if want, got := "a\nbc\nd\n", b.String(LogQuery{}); want != got {
+		t.Fatalf("want %q after flush, got %q", want, got)
+	}
+}
+
+func TestLogBufferLineCap(t *testing.T) {
+	b := NewLogBuffer(3, 0)
+	for i := 0; i < 5; i++ {
+		b.Printf(StreamBuild, "%d", i)
+	}
+	lines := b.Query(LogQuery{})
+	if want, got := 3, len(lines); want != got {
+		t.Fatalf("want %d lines, got %d", want, got)
+	}
+	if want, got := "2", lines[0].Text; want != got {
+		t.Fatalf("want oldest line %q, got %q", want, got)
+	}
+	if want, got := int64(5), lines[2].Seq; want != got {
+		t.Fatalf("want last seq %d, got %d", want, got)
+	}
+}
+
+func TestLogBufferByteCap(t *testing.T) {
+	b := NewLogBuffer(100, 10)
+	b.Add(StreamStdout, "12345")
+	b.Add(StreamStdout, "67890")
+	b.Add(StreamStdout, "abc")
+	if want, got := "67890\nabc\n", b.String(LogQuery{}); want != got {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestLogBufferLongLine(t *testing.T) {
+	b := NewLogBuffer(0, 0)
+	fmt.Fprint(b.Writer(StreamStdout), strings.Repeat("x", maxLineLen+1)+"\n")
+	lines := b.Query(LogQuery{})
+	if want, got := 2, len(lines); want != got {
+		t.Fatalf("want %d lines, got %d", want, got)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	b := NewLogBuffer(0, 0)
+	b.Add(StreamBuild, "build")
+	b.Add(StreamStdout, "out1")
+	mid := time.Now()
+	time.Sleep(time.Millisecond)
+	b.Add(StreamStderr, "err")
+	b.Add(StreamStdout, "out2")
+
+	for _, tt := range []struct {
+		q    LogQuery
+		want string
+	}{
+		{LogQuery{}, "build out1 err out2"},
+		{LogQuery{Streams: []Stream{StreamStdout}}, "out1 out2"},
+		{LogQuery{Streams: []Stream{StreamStdout, StreamStderr}, Limit: 2}, "err out2"},
+		{LogQuery{Since: mid}, "err out2"},
+		{LogQuery{Until: mid}, "build out1"},
+		{LogQuery{AfterSeq: 3}, "out2"},
+	} {
+		var got []string
+		for _, l := range b.Query(tt.q) {
+			got = append(got, l.Text)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("Query(%+v) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestLogBufferWait(t *testing.T) {
+	b := NewLogBuffer(0, 0)
+	_, changed := b.Wait(LogQuery{})
+	select {
+	case <-changed:
+		t.Fatal("changed before any lines were added")
+	default:
+	}
+	b.Add(StreamStdout, "x")
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("not notified of new line")
+	}
+}
+
+func TestLogBufferConcurrentWriters(t *testing.T) {
+	b := NewLogBuffer(0, 0)
+	var wg sync.WaitGroup
+	for _, s := range []Stream{StreamStdout, StreamStderr} {
+		wg.Add(1)
+		go func(s Stream) {
+			defer wg.Done()
+			w := b.Writer(s)
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(w, "%s %d\n", s, i)
+			}
+		}(s)
+	}
+	for i := 0; i < 10; i++ {
+		b.Query(LogQuery{})
+	}
+	wg.Wait()
+	if want, got := 100, len(b.Query(LogQuery{Streams: []Stream{StreamStderr}})); want != got {
+		t.Fatalf("want %d stderr lines, got %d", want, got)
+	}
+}
+
+func TestParseStream(t *testing.T) {
+	if s, err := ParseStream(" stderr"); err != nil || s != StreamStderr {
+		t.Errorf("ParseStream(stderr) = %q, %v", s, err)
+	}
+	if _, err := ParseStream("stdin"); err == nil {
+		t.Error("ParseStream(stdin) succeeded, want error")
+	}
+}
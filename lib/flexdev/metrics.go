@@ -0,0 +1,163 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsContentType is the content type of the server's metrics, the
+// Prometheus text exposition format.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metric is a single sample of a metric.
+type Metric struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// ParseMetrics reads samples in the Prometheus text format. Comments, and
+// thus type information, are skipped.
+func ParseMetrics(r io.Reader) ([]Metric, error) {
+	var metrics []Metric
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		m, err := parseMetric(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, s.Err()
+}
+
+func parseMetric(line string) (Metric, error) {
+	m := Metric{Labels: map[string]string{}}
+	i := strings.IndexAny(line, "{ ")
+	if i <= 0 {
+		return m, fmt.Errorf("bad sample %q", line)
+	}
+	m.Name, line = line[:i], line[i:]
+
+	if line[0] == '{' {
+		line = line[1:]
+		for {
+			line = strings.TrimLeft(line, " ,")
+			if strings.HasPrefix(line, "}") {
+				line = line[1:]
+				break
+			}
+			eq := strings.Index(line, `="`)
+			if eq <= 0 {
+				return m, fmt.Errorf("bad labels in sample of %s", m.Name)
+			}
+			name := strings.TrimSpace(line[:eq])
+			value, rest, err := unescapeLabel(line[eq+2:])
+			if err != nil {
+				return m, fmt.Errorf("bad label %s of %s: %v", name, m.Name, err)
+			}
+			m.Labels[name], line = value, rest
+		}
+	}
+
+	// The value may be followed by a timestamp.
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return m, fmt.Errorf("missing value of %s", m.Name)
+	}
+	v, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return m, fmt.Errorf("bad value of %s: %v", m.Name, err)
+	}
+	m.Value = v
+	return m, nil
+}
+
+// unescapeLabel reads a label value up to its closing quote, and returns the
+// rest of the line.
+func unescapeLabel(s string) (value, rest string, err error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", fmt.Errorf("unterminated value")
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated value")
+}
+
+// EscapeLabel escapes a label value for the text format.
+func EscapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// HistogramQuantile estimates the q-quantile (0 <= q <= 1) of a histogram
+// from its cumulative _bucket samples, interpolating linearly within the
+// bucket it falls in, as Prometheus does. It returns NaN if the histogram is
+// empty.
+func HistogramQuantile(q float64, buckets []Metric) float64 {
+	type bucket struct{ le, count float64 }
+	var bs []bucket
+	for _, m := range buckets {
+		le, err := strconv.ParseFloat(m.Labels["le"], 64)
+		if err != nil {
+			continue
+		}
+		bs = append(bs, bucket{le, m.Value})
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].le < bs[j].le })
+	if len(bs) == 0 || bs[len(bs)-1].count == 0 {
+		return math.NaN()
+	}
+
+	rank := q * bs[len(bs)-1].count
+	for i, b := range bs {
+		if b.count < rank {
+			continue
+		}
+		if math.IsInf(b.le, 1) {
+			// Past the largest finite bound, all we know is that.
+			if i == 0 {
+				return math.NaN()
+			}
+			return bs[i-1].le
+		}
+		lower, below := 0.0, 0.0
+		if i > 0 {
+			lower, below = bs[i-1].le, bs[i-1].count
+		}
+		if b.count == below {
+			return b.le
+		}
+		return lower + (b.le-lower)*(rank-below)/(b.count-below)
+	}
+	return bs[len(bs)-1].le
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseMetrics(t *testing.T) {
+	in := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{slot="default",code="200"} 12
+requests_total{ slot="a\"b\\c" , code="503", } 1 1500000000000
+
+up 1
+latency_bucket{le="+Inf"} 3
+`
+	got, err := ParseMetrics(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Metric{
+		{"requests_total", map[string]string{"slot": "default", "code": "200"}, 12},
+		{"requests_total", map[string]string{"slot": `a"b\c`, "code": "503"}, 1},
+		{"up", map[string]string{}, 1},
+		{"latency_bucket", map[string]string{"le": "+Inf"}, 3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d samples, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || got[i].Value != want[i].Value || len(got[i].Labels) != len(want[i].Labels) {
+			t.Errorf("sample %d: want %+v, got %+v", i, want[i], got[i])
+			continue
+		}
+		for k, v := range want[i].Labels {
+			if got[i].Labels[k] != v {
+				t.Errorf("sample %d: want %s=%q, got %q", i, k, v, got[i].Labels[k])
+			}
+		}
+	}
+
+	for _, in := range []string{"{a=\"b\"} 1", "x{a=\"b} 1", "x{a} 1", "x", "x one"} {
+		if _, err := ParseMetrics(strings.NewReader(in)); err == nil {
+			t.Errorf("ParseMetrics(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	v := "a\"b\\c\nd"
+	m, err := ParseMetrics(strings.NewReader(`x{v="` + EscapeLabel(v) + `"} 1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m[0].Labels["v"]; got != v {
+		t.Errorf("want %q, got %q", v, got)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	bucket := func(le string, n float64) Metric {
+		return Metric{Name: "x_bucket", Labels: map[string]string{"le": le}, Value: n}
+	}
+	h := []Metric{bucket("+Inf", 100), bucket("0.1", 50), bucket("1", 90), bucket("10", 100)}
+	for _, tt := range []struct {
+		q, want float64
+	}{
+		{0.5, 0.1},
+		{0.25, 0.05},
+		{0.7, 0.55},
+		{0.95, 5.5},
+		{1, 10},
+	} {
+		if got := HistogramQuantile(tt.q, h); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("HistogramQuantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	if got := HistogramQuantile(0.99, []Metric{bucket("1", 1), bucket("+Inf", 2)}); got != 1 {
+		t.Errorf("quantile past the last bound = %v, want 1", got)
+	}
+	if got := HistogramQuantile(0.5, []Metric{bucket("+Inf", 0)}); !math.IsNaN(got) {
+		t.Errorf("quantile of empty histogram = %v, want NaN", got)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Paths in the build directory that belong to the server, not the app.
+var reservedPaths = []string{
+	"flexdev-server", // The app's binary.
+	"flexdev.sock",   // Where older servers put the app's unix socket.
+	"_gopath/pkg",    // Compiled dependencies.
+}
+
+// ReservedPath returns the reserved path that p, a clean path relative to the
+// build directory, is or is in, if any. Those belong to the server, not the
+// app.
+func ReservedPath(p string) (string, bool) {
+	for _, r := range reservedPaths {
+		if p == r || strings.HasPrefix(p, r+"/") {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// CleanPath canonicalizes p, a slash-separated path relative to the app's
+// root sent by the client, and checks that it is safe to create or remove:
+// it must not be absolute, escape the root, contain NUL, control characters
+// or backslashes, or name one of the server's own files.
+func CleanPath(p string) (string, error) {
+	if p == "" {
+		return "", errors.New("empty path")
+	}
+	for _, c := range p {
+		if c == 0 {
+			return "", errors.New("contains NUL")
+		}
+		if c < 0x20 || c == 0x7f {
+			return "", errors.New("contains control characters")
+		}
+	}
+	if strings.Contains(p, `\`) {
+		return "", errors.New("contains a backslash; use forward slashes")
+	}
+	if path.IsAbs(p) || filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return "", errors.New("absolute path")
+	}
+	clean := path.Clean(p)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("escapes the app directory")
+	}
+	if clean == "." {
+		return "", errors.New("names the app directory itself")
+	}
+	if r, ok := ReservedPath(clean); ok {
+		return "", fmt.Errorf("reserved for the flexdev server (%s)", r)
+	}
+	return clean, nil
+}
+
+// JoinPath cleans p with CleanPath and joins it to dir. It also checks that
+// no symlink in dir, including p itself, leads the result out of dir.
+func JoinPath(dir, p string) (string, error) {
+	clean, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	// Resolve the path, or its deepest ancestor that exists; the rest is yet
+	// to be created.
+	full := filepath.Join(dir, filepath.FromSlash(clean))
+	for existing := full; ; existing = filepath.Dir(existing) {
+		real, err := filepath.EvalSymlinks(existing)
+		if os.IsNotExist(err) && existing != dir {
+			if _, err := os.Lstat(existing); err == nil {
+				return "", errors.New("goes through a broken symlink")
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return "", errors.New("leads out of the app directory through a symlink")
+		}
+		return full, nil
+	}
+}
+
+// BadPath is a path that CleanPath rejected, and why.
+type BadPath struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// BadPaths is the error returned for a list with rejected paths.
+type BadPaths []BadPath
+
+func (b BadPaths) Error() string {
+	l := make([]string, len(b))
+	for i, p := range b {
+		l[i] = fmt.Sprintf("%q: %s", p.Path, p.Reason)
+	}
+	if len(b) == 1 {
+		return "bad path " + l[0]
+	}
+	return fmt.Sprintf("%d bad paths: %s", len(b), strings.Join(l, "; "))
+}
+
+// Clean returns d with its paths canonicalized by CleanPath, keeping the
+// entry for the root directory itself. If any path is rejected, or more than
+// one entry has the same path, it returns BadPaths listing all of them.
+func (d DirList) Clean() (DirList, error) {
+	var bad BadPaths
+	seen := map[string]bool{}
+	clean := make(DirList, 0, len(d))
+	for _, e := range d {
+		if e.Path == "." && e.IsDir {
+			clean = append(clean, e)
+			continue
+		}
+		p, err := CleanPath(e.Path)
+		if err != nil {
+			bad = append(bad, BadPath{e.Path, err.Error()})
+			continue
+		}
+		if seen[p] {
+			bad = append(bad, BadPath{e.Path, "listed more than once"})
+			continue
+		}
+		seen[p] = true
+		e.Path = p
+		clean = append(clean, e)
+	}
+	if bad != nil {
+		return nil, bad
+	}
+	return clean, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"main.go":           "main.go",
+		"static/css/a.css":  "static/css/a.css",
+		"./a//b/":           "a/b",
+		"a/../b":            "b",
+		"_gopath/src/x.go":  "_gopath/src/x.go",
+		"flexdev-server.go": "flexdev-server.go",
+	} {
+		got, err := CleanPath(in)
+		if err != nil {
+			t.Errorf("CleanPath(%q): %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("CleanPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for _, in := range []string{
+		"", ".", "a/..", "..", "../x", "a/../../x", "/etc/passwd",
+		"a\x00b", "a\nb", `..\x`, `C:\x`,
+		"flexdev-server", "flexdev.sock", "_gopath/pkg", "./_gopath/pkg/linux_amd64/x.a",
+	} {
+		if got, err := CleanPath(in); err == nil {
+			t.Errorf("CleanPath(%q) = %q, want error", in, got)
+		}
+	}
+}
+
+func TestReservedPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"flexdev-server":          "flexdev-server",
+		"_gopath/pkg/linux/x.a":   "_gopath/pkg",
+		"_gopath/src/x/y.go":      "",
+		"flexdev-server-notes.md": "",
+		"main.go":                 "",
+	} {
+		got, ok := ReservedPath(in)
+		if got != want || ok != (want != "") {
+			t.Errorf("ReservedPath(%q) = %q, %v; want %q", in, got, ok, want)
+		}
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexdev-path-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "flexdev-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Skipf("no symlinks: %v", err)
+	}
+	if err := os.Symlink("sub", filepath.Join(dir, "in")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "f"), filepath.Join(dir, "outfile")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a", "sub/a", "new/dir/a", "in/a"} {
+		got, err := JoinPath(dir, p)
+		if err != nil {
+			t.Errorf("JoinPath(%q): %v", p, err)
+			continue
+		}
+		if want := filepath.Join(dir, filepath.FromSlash(p)); got != want {
+			t.Errorf("JoinPath(%q) = %q, want %q", p, got, want)
+		}
+	}
+	for _, p := range []string{"out/a", "out/new/a", "outfile", "../a"} {
+		if got, err := JoinPath(dir, p); err == nil {
+			t.Errorf("JoinPath(%q) = %q, want error", p, got)
+		}
+	}
+}
+
+func TestDirListClean(t *testing.T) {
+	got, err := DirList{{Path: ".", IsDir: true}, {Path: "./a"}, {Path: "b/"}}.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "., a, b", got[0].Path+", "+got[1].Path+", "+got[2].Path; want != got {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	_, err = DirList{{Path: "a"}, {Path: "../x"}, {Path: "./a"}, {Path: "flexdev-server"}}.Clean()
+	bad, ok := err.(BadPaths)
+	if !ok {
+		t.Fatalf("want BadPaths, got %v", err)
+	}
+	if want, got := 3, len(bad); want != got {
+		t.Fatalf("want %d bad paths, got %v", want, bad)
+	}
+	for i, p := range []string{"../x", "./a", "flexdev-server"} {
+		if bad[i].Path != p {
+			t.Errorf("bad path %d: want %q, got %q", i, p, bad[i].Path)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import "time"
+
+// ShadowReport compares the responses of a slot's app with those of a
+// candidate app that a share of its requests is mirrored to.
+type ShadowReport struct {
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Percent    float64   `json:"percent"`
+	AllMethods bool      `json:"all_methods,omitempty"`
+	Since      time.Time `json:"since"`
+
+	Mirrored int `json:"mirrored"`
+	Matched  int `json:"matched"`
+	Differed int `json:"differed"`
+	Failed   int `json:"failed"` // The candidate couldn't be reached.
+
+	// Paths summarizes mirrored requests by method and path, most
+	// differences first.
+	Paths []ShadowPath `json:"paths,omitempty"`
+
+	// Diffs are the most recent differences, oldest first.
+	Diffs []ShadowDiff `json:"diffs,omitempty"`
+}
+
+type ShadowPath struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Mirrored int    `json:"mirrored"`
+	Differed int    `json:"differed"`
+	Failed   int    `json:"failed"`
+}
+
+// ShadowDiff is a request that got different responses. Bodies are
+// truncated.
+type ShadowDiff struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	Error  string    `json:"error,omitempty"`
+
+	Status            int    `json:"status"`
+	CandidateStatus   int    `json:"candidate_status"`
+	BodySize          int64  `json:"body_size"`
+	CandidateBodySize int64  `json:"candidate_body_size"`
+	Body              []byte `json:"body,omitempty"`
+	CandidateBody     []byte `json:"candidate_body,omitempty"`
+}
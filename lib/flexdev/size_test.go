@@ -0,0 +1,63 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0":     0,
+		"512":   512,
+		"64K":   64 << 10,
+		"512M":  512 << 20,
+		"512MB": 512 << 20,
+		"1GiB":  1 << 30,
+		"2g":    2 << 30,
+		" 1T ":  1 << 40,
+	} {
+		got, err := ParseSize(in)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseSize(%q) = %d, want %d", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "M", "-1", "1.5G", "12Q", "99999999999T"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for in, want := range map[int64]string{
+		0:         "0",
+		1000:      "1000",
+		64 << 10:  "64K",
+		512 << 20: "512M",
+		3 << 30:   "3G",
+	} {
+		if got := FormatSize(in); got != want {
+			t.Errorf("FormatSize(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for in, want := range map[int64]string{
+		0:               "0",
+		1000:            "1000",
+		64 << 10:        "64.0K",
+		1536 << 20:      "1.5G",
+		3<<30 + 1<<20:   "3.0G",
+		5<<40 + 512<<30: "5.5T",
+	} {
+		if got := HumanSize(in); got != want {
+			t.Errorf("HumanSize(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import "fmt"
+
+// DefaultSlot is the slot used when none is given.
+const DefaultSlot = "default"
+
+// SlotHeader selects the slot a proxied request goes to.
+const SlotHeader = "X-Flexdev-Slot"
+
+// CheckSlotName checks that name can be used as a slot name. Slot names are
+// also used as host name labels, so they are limited to lower case letters,
+// digits and hyphens.
+func CheckSlotName(name string) error {
+	if name == "" || len(name) > 40 {
+		return fmt.Errorf("Bad slot name %q. Must be 1 to 40 characters.", name)
+	}
+	for i, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '-' && i != 0 && i != len(name)-1:
+		default:
+			return fmt.Errorf("Bad slot name %q. Use lower case letters, digits and inner hyphens.", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import "testing"
+
+func TestCheckSlotName(t *testing.T) {
+	for _, name := range []string{"default", "alice", "feature-42", "a"} {
+		if err := CheckSlotName(name); err != nil {
+			t.Errorf("CheckSlotName(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Alice", "-a", "a-", "a_b", "a.b", "../x", "a/b", "0123456789012345678901234567890123456789x"} {
+		if err := CheckSlotName(name); err == nil {
+			t.Errorf("CheckSlotName(%q) succeeded, want error", name)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadTokenHeader carries the token issued by build/create on the put and
+// start requests of the same deploy.
+const UploadTokenHeader = "X-Flexdev-Upload-Token"
+
+// NewUploadToken returns a random, unguessable upload token.
+func NewUploadToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CheckUploadToken reports whether got is want, in constant time.
+func CheckUploadToken(got, want string) error {
+	if got == "" {
+		return fmt.Errorf("missing %s header", UploadTokenHeader)
+	}
+	if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errors.New("upload token does not match")
+	}
+	return nil
+}
+
+// UploadLimits cap what deploys may upload to the server. Zero means no limit.
+type UploadLimits struct {
+	MaxFileSize  int64 `json:"max_file_size"`  // Bytes in one file.
+	MaxBuildSize int64 `json:"max_build_size"` // Bytes in all of a build's files.
+	MaxFiles     int   `json:"max_files"`      // Files in a build.
+	MaxUploads   int   `json:"max_uploads"`    // Files being uploaded at once, by all deploys.
+}
+
+// Check returns an error if the files in d, a deploy's dir list, break the
+// limits. Files that are too big on their own are returned as BadPaths. If
+// the build is too big in all, the error names its largest files.
+func (l UploadLimits) Check(d DirList) error {
+	var files DirList
+	var total int64
+	for _, e := range d {
+		if !e.IsDir {
+			files = append(files, e)
+			total += e.Size
+		}
+	}
+	if l.MaxFiles > 0 && len(files) > l.MaxFiles {
+		return fmt.Errorf("%d files, more than the limit of %d per build", len(files), l.MaxFiles)
+	}
+	var bad BadPaths
+	for _, e := range files {
+		switch {
+		case e.Size < 0:
+			bad = append(bad, BadPath{e.Path, "negative size"})
+		case l.MaxFileSize > 0 && e.Size > l.MaxFileSize:
+			bad = append(bad, BadPath{e.Path, fmt.Sprintf("%s, more than the limit of %s per file", HumanSize(e.Size), HumanSize(l.MaxFileSize))})
+		}
+	}
+	if bad != nil {
+		return bad
+	}
+	if l.MaxBuildSize > 0 && total > l.MaxBuildSize {
+		sort.Slice(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+		var largest []string
+		for i := 0; i < len(files) && i < 3; i++ {
+			largest = append(largest, fmt.Sprintf("%s (%s)", files[i].Path, HumanSize(files[i].Size)))
+		}
+		return fmt.Errorf("%s in all, more than the limit of %s per build; the largest files are %s",
+			HumanSize(total), HumanSize(l.MaxBuildSize), strings.Join(largest, ", "))
+	}
+	return nil
+}
+
+// Manifest tracks the files a build expects the client to upload: the files
+// in its dir list that are, or are in, one of the paths the server asked for.
+type Manifest struct {
+	mu      sync.Mutex
+	files   map[string]DirEntry // The files that may be sent.
+	pending map[string]bool
+	active  time.Time // When a file was last checked or received.
+}
+
+// NewManifest returns the manifest of files to upload, given the client's
+// dir list and the paths the server needs.
+func NewManifest(files DirList, need []string) *Manifest {
+	m := &Manifest{
+		files:   map[string]DirEntry{},
+		pending: map[string]bool{},
+		active:  time.Now(),
+	}
+	needed := map[string]bool{}
+	for _, p := range need {
+		needed[p] = true
+	}
+	for _, e := range files {
+		if e.IsDir {
+			continue
+		}
+		for p := e.Path; ; {
+			if needed[p] {
+				m.files[e.Path] = e
+				m.pending[e.Path] = true
+				break
+			}
+			i := strings.LastIndex(p, "/")
+			if i < 0 {
+				break
+			}
+			p = p[:i]
+		}
+	}
+	return m
+}
+
+// Check returns the size declared for path, or an error unless path is in the
+// manifest with the given SHA1.
+func (m *Manifest) Check(path, sha1 string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active = time.Now()
+	e, ok := m.files[path]
+	if !ok {
+		return 0, errors.New("not in the build's manifest")
+	}
+	if sha1 != e.SHA1 {
+		return 0, fmt.Errorf("sha1 %s does not match the manifest's %s", sha1, e.SHA1)
+	}
+	return e.Size, nil
+}
+
+// Received marks path as uploaded.
+func (m *Manifest) Received(path string) {
+	m.mu.Lock()
+	delete(m.pending, path)
+	m.active = time.Now()
+	m.mu.Unlock()
+}
+
+// Active returns when the client last sent, or started to send, a file.
+func (m *Manifest) Active() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// Missing returns the files that have not been uploaded yet, sorted.
+func (m *Manifest) Missing() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	missing := make([]string, 0, len(m.pending))
+	for p := range m.pending {
+		missing = append(missing, p)
+	}
+	sort.Strings(missing)
+	return missing
+}
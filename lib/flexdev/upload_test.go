@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flexdev
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	files := DirList{
+		{Path: ".", IsDir: true},
+		{Path: "app.yaml", SHA1: "a"},
+		{Path: "main.go", SHA1: "b", Size: 12},
+		{Path: "static", IsDir: true},
+		{Path: "static/css", IsDir: true},
+		{Path: "static/css/x.css", SHA1: "c"},
+		{Path: "static/y.js", SHA1: "d"},
+		{Path: "staticfile", SHA1: "e"},
+	}
+	m := NewManifest(files, []string{"main.go", "static/css"})
+
+	if want, got := []string{"main.go", "static/css/x.css"}, m.Missing(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Missing() = %v, want %v", got, want)
+	}
+	for _, tt := range []struct {
+		path, sha1 string
+		ok         bool
+	}{
+		{"main.go", "b", true},
+		{"static/css/x.css", "c", true},
+		{"main.go", "x", false},
+		{"app.yaml", "a", false},
+		{"static/y.js", "d", false},
+		{"static/css", "", false},
+		{"other.go", "b", false},
+	} {
+		if _, err := m.Check(tt.path, tt.sha1); (err == nil) != tt.ok {
+			t.Errorf("Check(%q, %q) = %v, want ok=%v", tt.path, tt.sha1, err, tt.ok)
+		}
+	}
+
+	if size, _ := m.Check("main.go", "b"); size != 12 {
+		t.Errorf("Check(main.go) size = %d, want 12", size)
+	}
+
+	m.Received("main.go")
+	if want, got := []string{"static/css/x.css"}, m.Missing(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Missing() = %v, want %v", got, want)
+	}
+}
+
+func TestCheckUploadToken(t *testing.T) {
+	tok, err := NewUploadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := NewUploadToken(); other == tok {
+		t.Errorf("NewUploadToken returned %q twice", tok)
+	}
+	if err := CheckUploadToken(tok, tok); err != nil {
+		t.Errorf("CheckUploadToken: %v", err)
+	}
+	for _, got := range []string{"", "x", tok[1:]} {
+		if err := CheckUploadToken(got, tok); err == nil {
+			t.Errorf("CheckUploadToken(%q) succeeded, want error", got)
+		}
+	}
+	if err := CheckUploadToken("", ""); err == nil {
+		t.Error("CheckUploadToken with no token issued succeeded, want error")
+	}
+}
+
+func TestUploadLimitsCheck(t *testing.T) {
+	files := DirList{
+		{Path: ".", IsDir: true},
+		{Path: "main.go", Size: 1 << 10},
+		{Path: "data", IsDir: true},
+		{Path: "data/big.bin", Size: 300 << 20},
+		{Path: "data/small.bin", Size: 50 << 20},
+	}
+	for _, tt := range []struct {
+		l    UploadLimits
+		want string
+	}{
+		{UploadLimits{}, ""},
+		{UploadLimits{MaxFiles: 3, MaxFileSize: 1 << 30, MaxBuildSize: 1 << 30}, ""},
+		{UploadLimits{MaxFiles: 2}, "3 files, more than the limit of 2 per build"},
+		{UploadLimits{MaxFileSize: 100 << 20}, `bad path "data/big.bin": 300.0M, more than the limit of 100.0M per file`},
+		{UploadLimits{MaxBuildSize: 200 << 20}, "350.0M in all, more than the limit of 200.0M per build; the largest files are data/big.bin (300.0M), data/small.bin (50.0M), main.go (1.0K)"},
+	} {
+		got := ""
+		if err := tt.l.Check(files); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%+v: Check = %q, want %q", tt.l, got, tt.want)
+		}
+	}
+	if _, ok := (UploadLimits{MaxFileSize: 1}).Check(files).(BadPaths); !ok {
+		t.Error("Check of a too big file did not return BadPaths")
+	}
+	if err := (UploadLimits{MaxBuildSize: 1 << 30}).Check(files); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+	if files[3].Path != "data/big.bin" {
+		t.Error("Check reordered the dir list")
+	}
+}
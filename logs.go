@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func doLogs() error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	follow := flags.Bool("f", false, "Keep streaming new lines, following new builds unless -build is set.")
+	n := flags.Int("n", 0, "Only show the last n lines. 0 means all.")
+	since := flags.String("since", "", "Only show lines newer than a duration (e.g. 10m) or an RFC 3339 time.")
+	stream := flags.String("stream", "", "Comma-separated streams to show: stdout, stderr, build, supervisor. Default all.")
+	buildID := flags.String("build", "", "ID of the build to show logs for. Defaults to the current build.")
+	slot := flags.String("slot", "", "Slot to show logs for. Defaults to the default slot.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	v := url.Values{}
+	if *follow {
+		v.Set("follow", "1")
+	}
+	if *n != 0 {
+		v.Set("n", strconv.Itoa(*n))
+	}
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			return err
+		}
+		v.Set("since", t.Format(time.RFC3339Nano))
+	}
+	if *stream != "" {
+		for _, s := range strings.Split(*stream, ",") {
+			if _, err := flexdev.ParseStream(s); err != nil {
+				return err
+			}
+		}
+		v.Set("stream", *stream)
+	}
+	if *buildID != "" {
+		v.Set("build", *buildID)
+	}
+	if *slot != "" {
+		v.Set("slot", *slot)
+	}
+
+	req, err := http.NewRequest("POST", *target+"/_flexdev/logs?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != flexdev.LogContentType {
+		_, err := readResponse(resp)
+		return err
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var l flexdev.LogLine
+		if err := dec.Decode(&l); err != nil {
+			if err == io.EOF && !*follow {
+				return nil
+			}
+			return fmt.Errorf("Log stream ended: %v", err)
+		}
+		fmt.Printf("%s %-10s %s\n", l.Time.Local().Format("15:04:05.000"), l.Stream, l.Text)
+	}
+}
+
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad -since %q: want a duration like 10m or an RFC 3339 time.", s)
+	}
+	return t, nil
+}
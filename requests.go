@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// doRequests lists requests captured by the proxy, or shows one in full.
+func doRequests() error {
+	flags := flag.NewFlagSet("requests", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	id := flags.String("id", "", "Show this request in full, including bodies.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	req, err := http.NewRequest("POST", *target+"/_flexdev/requests?"+url.Values{"id": {*id}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doReq(req)
+	if err != nil {
+		return err
+	}
+	if *id != "" {
+		for _, c := range resp.Requests {
+			printCaptured(c)
+		}
+		return nil
+	}
+	if len(resp.Requests) == 0 {
+		fmt.Fprintln(os.Stderr, "No captured requests. Set capture_requests in the flexdev config to record them.")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tSLOT\tBUILD\tMETHOD\tURL\tSTATUS\tDURATION")
+	for _, c := range resp.Requests {
+		u := c.URL
+		if c.ReplayOf != "" {
+			u += " (replay of " + c.ReplayOf + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%v\n", c.ID, c.Time.Local().Format("15:04:05"), c.Slot, c.Build, c.Method, u, c.Status, c.Duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// doReplay sends a captured request to the current build again.
+func doReplay() error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+	if flags.NArg() != 1 {
+		usage("Missing request ID. Use `flexdev requests` to list them.")
+	}
+
+	req, err := http.NewRequest("POST", *target+"/_flexdev/requests/replay?"+url.Values{"id": {flags.Arg(0)}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doReq(req)
+	if err != nil {
+		return err
+	}
+	for _, c := range resp.Requests {
+		printHeader(c.ResponseHeader)
+		fmt.Println()
+		os.Stdout.Write(c.ResponseBody)
+	}
+	return nil
+}
+
+func printCaptured(c flexdev.CapturedRequest) {
+	fmt.Printf("%s %s\nHost: %s\n", c.Method, c.URL, c.Host)
+	printHeader(c.Header)
+	fmt.Printf("\n%s", c.Body)
+	if c.BodyTruncated {
+		fmt.Print("\n[truncated]")
+	}
+	fmt.Printf("\n\n%d %s (%v, build %s)\n", c.Status, http.StatusText(c.Status), c.Duration, c.Build)
+	printHeader(c.ResponseHeader)
+	fmt.Printf("\n%s", c.ResponseBody)
+	if c.ResponseBodyTruncated {
+		fmt.Print("\n[truncated]")
+	}
+	fmt.Println()
+}
+
+func printHeader(h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Printf("%s: %s\n", k, v)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// doRunServer builds the flexdev server and runs it here, rather than on App
+// Engine. Auth settings other than the mode, such as FLEXDEV_AUTH_TOKEN_FILE,
+// are passed on from the environment.
+func doRunServer() error {
+	flags := flag.NewFlagSet("server run", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", ":8080", "Address to listen on.")
+	dir := flags.String("dir", "", "Directory to keep builds and server state in. Required.")
+	mode := flags.String("auth", os.Getenv("FLEXDEV_AUTH"), "How the server authenticates requests: hmac, token, mtls or none. Required.")
+	tlsCert := flags.String("tls-cert", os.Getenv("FLEXDEV_TLS_CERT"), "PEM certificate to serve TLS with.")
+	tlsKey := flags.String("tls-key", os.Getenv("FLEXDEV_TLS_KEY"), "PEM key of -tls-cert.")
+	if err := flags.Parse(flag.Args()[2:]); err != nil {
+		return err
+	}
+	if *dir == "" {
+		usage("Missing 'dir' flag.")
+	}
+	switch *mode {
+	case "":
+		usage("Missing 'auth' flag.")
+	case "appengine":
+		return errors.New("App Engine auth only works on App Engine. Use `flexdev server deploy`.")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		usage("Set both or neither of 'tls-cert' and 'tls-key'.")
+	}
+
+	return runServer([]string{"-addr", *addr, "-dir", *dir},
+		"FLEXDEV_AUTH="+*mode,
+		"FLEXDEV_TLS_CERT="+*tlsCert,
+		"FLEXDEV_TLS_KEY="+*tlsKey)
+}
+
+// runServer builds the server and runs it with args, and env added to this
+// process's environment, until it exits.
+func runServer(args []string, env ...string) error {
+	tmp, err := ioutil.TempDir("", "flexdev-server-")
+	if err != nil {
+		return fmt.Errorf("could not get a temp dir to build the server in: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Build in a GOPATH of its own, so the server's vendored packages are used.
+	root := filepath.Join(tmp, "src", "flexdev-server")
+	if err := copyServer(root); err != nil {
+		return err
+	}
+	bin := filepath.Join(tmp, "flexdev-server")
+	log.Print("Building the flexdev server.")
+	cmd := exec.Command("go", "build", "-o", bin, ".")
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(), "GOPATH="+tmp, "GO111MODULE=off")
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not build the server: %v", err)
+	}
+
+	cmd = exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+	// Leave the server to shut down on signals, then clean up.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Could not start the server: %v", err)
+	}
+	go func() {
+		for s := range sigs {
+			cmd.Process.Signal(s)
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("Server stopped: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+var serverAccess = &accessStore{path: filepath.Join(stateDir, "access.json")}
+
+// endpointRoles is the role needed for each admin endpoint. Endpoints that
+// aren't listed need an owner. Viewer endpoints mask secrets in what they show.
+var endpointRoles = map[string]flexdev.Role{
+	"/_flexdev/build/status":    flexdev.RoleViewer,
+	"/_flexdev/logs":            flexdev.RoleViewer,
+	"/_flexdev/env/list":        flexdev.RoleViewer,
+	"/_flexdev/requests":        flexdev.RoleViewer,
+	"/_flexdev/shadow/report":   flexdev.RoleViewer,
+	"/_flexdev/metrics":         flexdev.RoleViewer,
+	"/_flexdev/access/list":     flexdev.RoleViewer,
+	"/_flexdev/history":         flexdev.RoleViewer,
+	"/_flexdev/build/limits":    flexdev.RoleDeployer,
+	"/_flexdev/build/create":    flexdev.RoleDeployer,
+	"/_flexdev/build/put":       flexdev.RoleDeployer,
+	"/_flexdev/build/start":     flexdev.RoleDeployer,
+	"/_flexdev/app/start":       flexdev.RoleDeployer,
+	"/_flexdev/app/stop":        flexdev.RoleDeployer,
+	"/_flexdev/app/restart":     flexdev.RoleDeployer,
+	"/_flexdev/env/set":         flexdev.RoleDeployer,
+	"/_flexdev/env/unset":       flexdev.RoleDeployer,
+	"/_flexdev/requests/replay": flexdev.RoleDeployer,
+	"/_flexdev/shadow/start":    flexdev.RoleDeployer,
+	"/_flexdev/shadow/stop":     flexdev.RoleDeployer,
+}
+
+// accessStore holds the access policy set with `flexdev access`.
+type accessStore struct {
+	path string
+
+	mu     sync.Mutex
+	policy flexdev.Policy
+	loaded bool
+}
+
+func (s *accessStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.policy = make(flexdev.Policy)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &s.policy); err != nil {
+		return fmt.Errorf("Could not read %s: %v", s.path, err)
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *accessStore) save() error {
+	b, err := json.Marshal(s.policy)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// roleOf returns the role of id, if it has one.
+func (s *accessStore) roleOf(id identity) (flexdev.Role, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", false, err
+	}
+	r, ok := roleIn(s.policy, id)
+	return r, ok, nil
+}
+
+func roleIn(p flexdev.Policy, id identity) (flexdev.Role, bool) {
+	if id.owner || (id.trusted && len(p) == 0) {
+		return flexdev.RoleOwner, true
+	}
+	return p.RoleOf(id.name)
+}
+
+// change applies f to a copy of the policy, and saves it unless that would
+// leave by, who is making the change, without owner access.
+func (s *accessStore) change(by identity, f func(p flexdev.Policy)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	p := make(flexdev.Policy, len(s.policy))
+	for k, v := range s.policy {
+		p[k] = v
+	}
+	f(p)
+	if r, _ := roleIn(p, by); r != flexdev.RoleOwner {
+		return fmt.Errorf("This would take owner access away from you (%s).", by.name)
+	}
+	old := s.policy
+	s.policy = p
+	if err := s.save(); err != nil {
+		s.policy = old
+		return err
+	}
+	return nil
+}
+
+func (s *accessStore) grants() ([]flexdev.Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.policy.Grants(), nil
+}
+
+type identityKey struct{}
+
+// authorize checks that id may use the admin endpoint r is for, and returns r
+// with id in its context.
+func authorize(r *http.Request, id identity) (*http.Request, error) {
+	need, ok := endpointRoles[r.URL.Path]
+	if !ok {
+		need = flexdev.RoleOwner
+	}
+	role, ok, err := serverAccess.roleOf(id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read access policy: %v", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s has no access to this flexdev server.", id.name)
+	}
+	if !role.Allows(need) {
+		return nil, fmt.Errorf("%s has role %s, but %s needs role %s.", id.name, role, r.URL.Path, need)
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), nil
+}
+
+func requestIdentity(r *http.Request) identity {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id
+}
+
+func accessListHandler(w http.ResponseWriter, r *http.Request) {
+	grants, err := serverAccess.grants()
+	if err != nil {
+		Response{Error: err}.WriteTo(w)
+		return
+	}
+	id := requestIdentity(r)
+	role, _, _ := serverAccess.roleOf(id)
+	Response{
+		Access:  grants,
+		Message: fmt.Sprintf("You are %s, with role %s.", id.name, role),
+	}.WriteTo(w)
+}
+
+func accessGrantHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("identity")
+	if err := flexdev.CheckIdentity(name); err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	role, err := flexdev.ParseRole(r.FormValue("role"))
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	by := requestIdentity(r)
+	if err := serverAccess.change(by, func(p flexdev.Policy) { p[name] = role }); err != nil {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Could not grant %s to %s: %v", role, name, err)}.WriteTo(w)
+		return
+	}
+	log.Printf("%s granted %s to %s", by.name, role, name)
+	audit(r, flexdev.AuditEvent{Action: "access.grant", Details: name + "=" + string(role)})
+	Response{Message: fmt.Sprintf("Granted %s to %s.", role, name)}.WriteTo(w)
+}
+
+func accessRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("identity")
+	if name == "" {
+		Response{Code: http.StatusBadRequest, Error: errors.New("Missing identity.")}.WriteTo(w)
+		return
+	}
+	by := requestIdentity(r)
+	found := false
+	err := serverAccess.change(by, func(p flexdev.Policy) {
+		_, found = p[name]
+		delete(p, name)
+	})
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Could not revoke access of %s: %v", name, err)}.WriteTo(w)
+		return
+	}
+	if !found {
+		Response{Message: fmt.Sprintf("%s had no grant.", name)}.WriteTo(w)
+		return
+	}
+	log.Printf("%s revoked access of %s", by.name, name)
+	audit(r, flexdev.AuditEvent{Action: "access.revoke", Details: name})
+	Response{Message: fmt.Sprintf("Revoked access of %s.", name)}.WriteTo(w)
+}
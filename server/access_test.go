@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func TestAuthorize(t *testing.T) {
+	defer testAuth(t, noAuth{})()
+	if err := ioutil.WriteFile(serverAccess.path, []byte(`{"alice":"owner","bob":"deployer","carol":"viewer"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, path string
+		ok         bool
+	}{
+		{"carol", "/_flexdev/build/status", true},
+		{"carol", "/_flexdev/logs", true},
+		{"carol", "/_flexdev/env/list", true},
+		{"carol", "/_flexdev/build/create", false},
+		{"carol", "/_flexdev/env/set", false},
+		{"bob", "/_flexdev/build/put", true},
+		{"bob", "/_flexdev/app/restart", true},
+		{"bob", "/_flexdev/access/grant", false},
+		{"bob", "/_flexdev/unlisted", false},
+		{"alice", "/_flexdev/access/grant", true},
+		{"alice", "/_flexdev/unlisted", true},
+		{"dave", "/_flexdev/build/status", false},
+	} {
+		r := httptest.NewRequest("POST", tt.path, nil)
+		r, err := authorize(r, identity{name: tt.name, trusted: true})
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s on %s: err = %v, want allowed %v", tt.name, tt.path, err, tt.ok)
+			continue
+		}
+		if tt.ok && requestIdentity(r).name != tt.name {
+			t.Errorf("%s on %s: request identity = %q", tt.name, tt.path, requestIdentity(r).name)
+		}
+	}
+
+	// Viewers may list env, but only see secrets masked.
+	app := httptest.NewServer(nil)
+	defer app.Close()
+	_, done := testSlot(t, "viewer-env", app, testConfig(t, "runtime: go\nenv_variables:\n  DB_PASSWORD: hunter22"))
+	defer done()
+	r, err := authorize(httptest.NewRequest("GET", "/_flexdev/env/list?slot=viewer-env", nil), identity{name: "carol", trusted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	envListHandler(w, r)
+	var resp struct{ Env []flexdev.EnvVar }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	for _, v := range resp.Env {
+		if v.Name == "DB_PASSWORD" && v.Value != flexdev.Redacted {
+			t.Errorf("viewer sees DB_PASSWORD = %q", v.Value)
+		}
+	}
+}
+
+func TestAuthorizeEmptyPolicy(t *testing.T) {
+	defer testAuth(t, noAuth{})()
+	r := httptest.NewRequest("POST", "/_flexdev/access/grant", nil)
+	if _, err := authorize(r, identity{name: "alice", trusted: true}); err != nil {
+		t.Errorf("trusted identity with no policy: %v", err)
+	}
+	if _, err := authorize(r, identity{name: "mallory"}); err == nil {
+		t.Error("untrusted identity with no policy was allowed")
+	}
+}
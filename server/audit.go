@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+var auditLog = &auditStore{path: filepath.Join(stateDir, "audit.log")}
+
+// auditStore appends events to a file, one JSON object per line. Nothing in
+// it is ever rewritten.
+type auditStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *auditStore) append(e flexdev.AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *auditStore) read(q flexdev.AuditQuery) ([]flexdev.AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return flexdev.ReadAudit(f, q)
+}
+
+// audit records e, made by the identity r was authorized for. A failure to
+// record it doesn't fail the action, which has already happened.
+func audit(r *http.Request, e flexdev.AuditEvent) {
+	e.Time = time.Now()
+	e.Identity = requestIdentity(r).name
+	if e.Outcome == "" {
+		e.Outcome = "ok"
+	}
+	if err := auditLog.append(e); err != nil {
+		log.Printf("Could not write audit log: %v", err)
+	}
+}
+
+// outcome returns the Outcome of an action that ended with err.
+func outcome(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	q := flexdev.AuditQuery{
+		Action:   r.FormValue("action"),
+		Identity: r.FormValue("identity"),
+		Slot:     r.FormValue("slot"),
+		Build:    r.FormValue("build"),
+	}
+	if v := r.FormValue("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Bad since %q: %v", v, err)}.WriteTo(w)
+			return
+		}
+		q.Since = t
+	}
+	if v := r.FormValue("n"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Bad n %q.", v)}.WriteTo(w)
+			return
+		}
+		q.Limit = n
+	}
+	events, err := auditLog.read(q)
+	if err != nil {
+		Response{Error: fmt.Errorf("Could not read audit log: %v", err)}.WriteTo(w)
+		return
+	}
+	Response{History: events}.WriteTo(w)
+}
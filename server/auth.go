@@ -0,0 +1,354 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// An authenticator decides whether a request may use the admin API, and who
+// made it.
+type authenticator interface {
+	// authenticate returns errMissingAuth if r carries no credentials at all.
+	authenticate(r *http.Request) (identity, error)
+}
+
+// An identity is who made an authenticated request. Its role comes from the
+// access policy, unless it is an owner regardless.
+type identity struct {
+	name    string
+	owner   bool // An owner, whatever the policy says.
+	trusted bool // An owner while the policy is empty.
+}
+
+// A browserAuthenticator can tell who made a request to the app, from what a
+// browser sends, without reading its body. Authenticators that can't only
+// let in API clients.
+type browserAuthenticator interface {
+	authenticateBrowser(r *http.Request) (identity, error)
+}
+
+var errMissingAuth = errors.New("Missing auth token.")
+
+// Authentication modes, selected with $FLEXDEV_AUTH.
+const (
+	authAppEngine = "appengine"
+	authNone      = "none"
+	authHMAC      = "hmac"
+	authToken     = "token"
+	authMTLS      = "mtls"
+)
+
+// newAuthenticator returns the authenticator selected by the environment:
+//
+//	FLEXDEV_AUTH=appengine  App Engine admins, via OAuth (default).
+//	FLEXDEV_AUTH=none       Anyone. Same as setting FLEXDEV_NOAUTH.
+//	FLEXDEV_AUTH=hmac       Requests signed with the secret in
+//	                        $FLEXDEV_AUTH_SECRET or $FLEXDEV_AUTH_SECRET_FILE.
+//	FLEXDEV_AUTH=token      Bearer tokens listed in $FLEXDEV_AUTH_TOKEN_FILE,
+//	                        one per line.
+//	FLEXDEV_AUTH=mtls       Client certificates signed by the CA in
+//	                        $FLEXDEV_TLS_CLIENT_CA, optionally limited to the
+//	                        names in $FLEXDEV_AUTH_NAMES.
+func newAuthenticator() (authenticator, error) {
+	mode := os.Getenv("FLEXDEV_AUTH")
+	if os.Getenv("FLEXDEV_NOAUTH") != "" {
+		if mode != "" && mode != authNone {
+			return nil, fmt.Errorf("FLEXDEV_NOAUTH is set, but FLEXDEV_AUTH is %q.", mode)
+		}
+		mode = authNone
+	}
+	switch mode {
+	case "", authAppEngine:
+		return appEngineAuth{}, nil
+	case authNone:
+		return noAuth{}, nil
+	case authHMAC:
+		secret := []byte(os.Getenv("FLEXDEV_AUTH_SECRET"))
+		if f := os.Getenv("FLEXDEV_AUTH_SECRET_FILE"); f != "" {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read secret: %v", err)
+			}
+			secret = bytes.TrimSpace(b)
+		}
+		if len(secret) == 0 {
+			return nil, errors.New("hmac auth needs FLEXDEV_AUTH_SECRET or FLEXDEV_AUTH_SECRET_FILE.")
+		}
+		return newHMACAuth(secret), nil
+	case authToken:
+		f := os.Getenv("FLEXDEV_AUTH_TOKEN_FILE")
+		if f == "" {
+			return nil, errors.New("token auth needs FLEXDEV_AUTH_TOKEN_FILE.")
+		}
+		a := &tokenAuth{file: f}
+		if _, err := a.load(); err != nil {
+			return nil, err
+		}
+		return a, nil
+	case authMTLS:
+		if os.Getenv("FLEXDEV_TLS_CLIENT_CA") == "" {
+			return nil, errors.New("mtls auth needs FLEXDEV_TLS_CLIENT_CA, and FLEXDEV_TLS_CERT and FLEXDEV_TLS_KEY to serve TLS.")
+		}
+		a := mtlsAuth{}
+		for _, n := range strings.Split(os.Getenv("FLEXDEV_AUTH_NAMES"), ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				a.names = append(a.names, n)
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("Unknown FLEXDEV_AUTH %q. Want one of %q, %q, %q, %q or %q.", mode, authAppEngine, authNone, authHMAC, authToken, authMTLS)
+}
+
+type noAuth struct{}
+
+func (noAuth) authenticate(r *http.Request) (identity, error) {
+	return identity{name: "anonymous", owner: true}, nil
+}
+
+func (a noAuth) authenticateBrowser(r *http.Request) (identity, error) {
+	return a.authenticate(r)
+}
+
+// appEngineAuth identifies Google accounts by email. App Engine admins are
+// owners.
+type appEngineAuth struct{}
+
+func (appEngineAuth) authenticate(r *http.Request) (identity, error) {
+	if r.Header.Get("Authorization") == "" {
+		return identity{}, errMissingAuth
+	}
+	u, err := user.CurrentOAuth(appengine.NewContext(r),
+		"https://www.googleapis.com/auth/cloud-platform",
+		"https://www.googleapis.com/auth/appengine.apis")
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{name: u.Email, owner: u.Admin}, nil
+}
+
+// authenticateBrowser identifies users signed in to the app with their Google
+// account, whom App Engine names in the request's headers.
+func (appEngineAuth) authenticateBrowser(r *http.Request) (identity, error) {
+	u := user.Current(appengine.NewContext(r))
+	if u == nil {
+		return identity{}, errMissingAuth
+	}
+	return identity{name: u.Email, owner: u.Admin}, nil
+}
+
+// hmacAuth lets in requests signed with a shared secret, as identity "hmac".
+// The signature covers a hash of the body, which is checked as the body is
+// read. Each signature is only accepted once. Browsers can't sign requests, so
+// it doesn't authenticate them for error pages.
+type hmacAuth struct {
+	secret []byte
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // Until when each nonce seen would be valid.
+}
+
+func newHMACAuth(secret []byte) *hmacAuth {
+	return &hmacAuth{secret: secret, nonces: map[string]time.Time{}}
+}
+
+func (a *hmacAuth) authenticate(r *http.Request) (identity, error) {
+	if r.Header.Get("Authorization") == "" {
+		return identity{}, errMissingAuth
+	}
+	now := time.Now()
+	sig, err := flexdev.VerifyRequest(r, a.secret, now)
+	if err != nil {
+		return identity{}, err
+	}
+	if r.ContentLength < 0 {
+		// Without a length, the body can only be checked once all read.
+		return identity{}, errors.New("Signed requests need a Content-Length.")
+	}
+	if err := a.use(sig, now); err != nil {
+		return identity{}, err
+	}
+	flexdev.VerifyBody(r)
+	return identity{name: "hmac", trusted: true}, nil
+}
+
+// use records sig's nonce, or fails if it has been seen before. Nonces are
+// forgotten once their signature is too old to be accepted anyway.
+func (a *hmacAuth) use(sig flexdev.Signature, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for n, until := range a.nonces {
+		if now.After(until) {
+			delete(a.nonces, n)
+		}
+	}
+	if _, ok := a.nonces[sig.Nonce]; ok {
+		return errors.New("Signature already used.")
+	}
+	a.nonces[sig.Nonce] = sig.Time.Add(flexdev.MaxClockSkew)
+	return nil
+}
+
+// tokenAuth lets in requests with any of the bearer tokens in a file, one per
+// line, optionally followed by the name to identify its holder by. The file
+// is read again when it changes, so tokens can be added and revoked without a
+// restart.
+type tokenAuth struct {
+	file string
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []bearerToken
+}
+
+type bearerToken struct {
+	token []byte
+	name  string
+}
+
+func (a *tokenAuth) load() ([]bearerToken, error) {
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read tokens: %v", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if fi.ModTime().Equal(a.modTime) {
+		return a.tokens, nil
+	}
+	b, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read tokens: %v", err)
+	}
+	var tokens []bearerToken
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		t := bearerToken{token: []byte(f[0])}
+		if len(f) > 1 {
+			t.name = f[1]
+		} else {
+			// Don't let the token itself show up as a name.
+			sum := sha256.Sum256(t.token)
+			t.name = "token:" + hex.EncodeToString(sum[:])[:12]
+		}
+		tokens = append(tokens, t)
+	}
+	a.tokens, a.modTime = tokens, fi.ModTime()
+	return tokens, nil
+}
+
+func (a *tokenAuth) authenticate(r *http.Request) (identity, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return identity{}, errMissingAuth
+	}
+	if !strings.HasPrefix(h, "Bearer ") {
+		return identity{}, errors.New("Want a bearer token.")
+	}
+	got := []byte(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+	tokens, err := a.load()
+	if err != nil {
+		return identity{}, err
+	}
+	id := identity{trusted: true}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(got, t.token) == 1 {
+			id.name = t.name
+		}
+	}
+	if id.name == "" {
+		return identity{}, errors.New("Unknown token.")
+	}
+	return id, nil
+}
+
+// authenticateBrowser lets API clients such as curl see what browsers can't.
+func (a *tokenAuth) authenticateBrowser(r *http.Request) (identity, error) {
+	return a.authenticate(r)
+}
+
+// mtlsAuth lets in requests with a client certificate signed by the client
+// CA, and if names is set, with one of them as its common name or as a DNS
+// or email subject alternative name. The identity is the matching name, or
+// the common name.
+type mtlsAuth struct {
+	names []string
+}
+
+func (a mtlsAuth) authenticate(r *http.Request) (identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return identity{}, errMissingAuth
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(a.names) == 0 {
+		return identity{name: cert.Subject.CommonName, trusted: true}, nil
+	}
+	certNames := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	certNames = append(certNames, cert.EmailAddresses...)
+	for _, n := range a.names {
+		for _, cn := range certNames {
+			if n == cn {
+				return identity{name: n, trusted: true}, nil
+			}
+		}
+	}
+	return identity{}, fmt.Errorf("Client certificate for %q is not allowed.", cert.Subject.CommonName)
+}
+
+func (a mtlsAuth) authenticateBrowser(r *http.Request) (identity, error) {
+	return a.authenticate(r)
+}
+
+// tlsConfig returns the TLS config to serve with, if $FLEXDEV_TLS_CERT and
+// $FLEXDEV_TLS_KEY are set, or nil otherwise. Client certificates are
+// verified against $FLEXDEV_TLS_CLIENT_CA, if set, but only the admin API
+// requires them.
+func tlsConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("FLEXDEV_TLS_CERT"), os.Getenv("FLEXDEV_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load TLS certificate: %v", err)
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if f := os.Getenv("FLEXDEV_TLS_CLIENT_CA"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read client CA: %v", err)
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates in client CA %s.", f)
+		}
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c, nil
+}
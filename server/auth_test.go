@@ -0,0 +1,138 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func signedRequest(t *testing.T, secret, signed, sent []byte) (*http.Request, *countingReader) {
+	body := &countingReader{r: bytes.NewReader(sent)}
+	r := httptest.NewRequest("POST", "/_flexdev/build/put?id=1&filename=a", body)
+	r.ContentLength = int64(len(sent))
+	if err := flexdev.SignRequest(r, signed, secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return r, body
+}
+
+func TestHMACAuth(t *testing.T) {
+	secret := []byte("s3cret")
+	a := newHMACAuth(secret)
+	body := []byte("file contents")
+
+	r, sent := signedRequest(t, secret, body, body)
+	id, err := a.authenticate(r)
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if want, got := "hmac", id.name; want != got {
+		t.Errorf("want identity %s, got %s", want, got)
+	}
+	if sent.n != 0 {
+		t.Errorf("authenticate read %d bytes of the body", sent.n)
+	}
+	if got, err := ioutil.ReadAll(r.Body); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("body = %q, %v; want %q", got, err, body)
+	}
+
+	// The same signature again.
+	replay := httptest.NewRequest("POST", r.URL.String(), bytes.NewReader(body))
+	replay.Header = r.Header
+	if _, err := a.authenticate(replay); err == nil {
+		t.Error("replayed request authenticated")
+	}
+
+	r, _ = signedRequest(t, secret, body, []byte("file c0ntents"))
+	if _, err := a.authenticate(r); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if got, err := ioutil.ReadAll(r.Body); err == nil {
+		t.Errorf("read tampered body %q without error", got)
+	}
+
+	r, _ = signedRequest(t, []byte("guess"), body, body)
+	if _, err := a.authenticate(r); err == nil {
+		t.Error("request signed with another secret authenticated")
+	}
+}
+
+func TestHMACNoncesExpire(t *testing.T) {
+	a := newHMACAuth([]byte("s3cret"))
+	now := time.Now()
+	sig := flexdev.Signature{Time: now, Nonce: "n"}
+	if err := a.use(sig, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.use(sig, now.Add(time.Second)); err == nil {
+		t.Error("nonce used twice")
+	}
+	a.use(flexdev.Signature{Time: now, Nonce: "m"}, now.Add(flexdev.MaxClockSkew+time.Second))
+	if _, ok := a.nonces["n"]; ok {
+		t.Error("expired nonce kept")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(tokens, []byte("# comment\ntokA alice\ntokB\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &tokenAuth{file: tokens}
+
+	auth := func(h string) (identity, error) {
+		r := httptest.NewRequest("GET", "/_flexdev/build/status", nil)
+		if h != "" {
+			r.Header.Set("Authorization", h)
+		}
+		return a.authenticate(r)
+	}
+	if _, err := auth(""); err != errMissingAuth {
+		t.Errorf("no token: err = %v, want errMissingAuth", err)
+	}
+	for _, h := range []string{"Basic tokA", "Bearer tok", "Bearer tokAA", "Bearer # comment"} {
+		if id, err := auth(h); err == nil {
+			t.Errorf("%q authenticated as %q", h, id.name)
+		}
+	}
+	if id, err := auth("Bearer tokA"); err != nil || id.name != "alice" || !id.trusted {
+		t.Errorf("tokA = %+v, %v; want trusted alice", id, err)
+	}
+	id, err := auth("Bearer tokB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id.name, "token:") || strings.Contains(id.name, "tokB") {
+		t.Errorf("unnamed token has name %q", id.name)
+	}
+}
@@ -6,15 +6,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/broady/flexdev/lib/flexdev"
 )
@@ -22,13 +24,25 @@ import (
 type Build struct {
 	flexdev.Build
 
+	slot        *slot
 	clientFiles flexdev.DirList
 	remove      []string
 	dir         string
 	cmd         *exec.Cmd
-	output      bytes.Buffer
+	logs        *flexdev.LogBuffer
 	addr        string
+	socket      string
+	transport   http.RoundTripper // nil means http.DefaultTransport.
+	cgroup      string
+	exit        string
+	starts      int // Number of times the app has been started.
+	created     time.Time
 	config      *config
+	uploadToken string            // Required on put and start; see createBuildHandler.
+	manifest    *flexdev.Manifest // Files the client still has to put.
+	treeHash    string            // Of the client's files.
+	added       []string          // Paths the client was asked for.
+	removed     []string          // Paths removed from the previous build.
 }
 
 func (b *Build) Cleanup() error {
@@ -48,12 +62,20 @@ func (b *Build) GoBuild() error {
 	cmd := exec.Command("go", "install",
 		"-tags", "appenginevm")
 	cmd.Dir = b.dir
-	cmd.Stdout, cmd.Stderr = &b.output, &b.output
+	cmd.Stdout, cmd.Stderr = b.logs.Writer(flexdev.StreamBuild), b.logs.Writer(flexdev.StreamBuild)
 	cmd.Env = os.Environ()
 	cmd.Env = env(cmd.Env, "GOPATH", os.Getenv("GOPATH")+":"+filepath.Join(b.dir, "_gopath"))
 	cmd.Env = env(cmd.Env, "GOBIN", b.dir)
 
-	if err := cmd.Run(); err != nil {
+	b.logs.Add(flexdev.StreamSupervisor, "Building.")
+	b.slot.publish()
+	start := time.Now()
+	err := cmd.Run()
+	deployPhase.observe(time.Since(start).Seconds(), b.slot.name, "build")
+	b.logs.Flush()
+	if err != nil {
+		b.State = flexdev.StateFailed
+		b.logs.Printf(flexdev.StreamSupervisor, "Build failed: %v", err)
 		return err
 	}
 
@@ -61,38 +83,190 @@ func (b *Build) GoBuild() error {
 	return nil
 }
 
-func (b *Build) Start() error {
-	l, err := net.Listen("tcp", ":0")
+// Start runs the built binary. If it fails, the build is left built.
+func (b *Build) Start() (err error) {
+	start := time.Now()
+	b.State = flexdev.StateStarting
+	b.slot.publish()
+	defer func() {
+		if err != nil {
+			b.State = flexdev.StateBuilt
+		}
+	}()
+
+	// The shell wrapping the app would start without it.
+	if _, err := os.Stat(filepath.Join(b.dir, "flexdev-server")); err != nil {
+		return err
+	}
+	// The app runs in a shell that applies the limits to itself, and then
+	// execs it.
+	cgroup, wrapper, err := prepareLimits(b.slot.cgroupName(), b.config.Flexdev.Limits)
 	if err != nil {
 		return err
 	}
-	b.addr = l.Addr().String()
-	l.Close()
-
-	_, port, err := net.SplitHostPort(b.addr)
+	// Apps that don't take the listener bind $PORT, which may be taken by
+	// the time they do. In unix mode, this keeps them away from the server's
+	// $PORT.
+	_, port, err := reservePort()
+	if err != nil {
+		return err
+	}
+	l, err := b.listen()
 	if err != nil {
 		return err
 	}
+	environ := env(os.Environ(), "GOPATH", filepath.Join(b.dir, "_gopath"))
+	environ = env(environ, "PORT", port)
 
-	cmd := exec.Command("./flexdev-server")
-	cmd.Dir = b.dir
-	cmd.Stdout, cmd.Stderr = &b.output, &b.output
-	environ := env(os.Environ(), "PORT", fmt.Sprintf("%s", port))
-	environ = env(environ, "GOPATH", filepath.Join(b.dir, "_gopath"))
-	for k, v := range build.config.Env {
-		environ = env(environ, k, v)
+	var h *handoff
+	switch {
+	case l == nil:
+		b.addr = net.JoinHostPort("127.0.0.1", port)
+	case b.socket == "":
+		h = newHandoff(b.addr, net.JoinHostPort("127.0.0.1", port))
+		b.transport = &http.Transport{DialContext: h.dial}
+	}
+
+	var files []*os.File
+
+	if l != nil {
+		f, err := l.File()
+		l.Close()
+		if err != nil {
+			return err
+		}
+		// The child gets its own copy of the descriptor.
+		defer f.Close()
+
+		// systemd-style socket activation. LISTEN_PID must be the pid of the
+		// app, which is only known after fork, so let the shell set it.
+		wrapper += "LISTEN_PID=$$; export LISTEN_PID; "
+		files = []*os.File{f}
+		environ = env(environ, "LISTEN_FDS", "1")
+		environ = env(environ, "LISTEN_FDNAMES", "http")
+		if b.socket != "" {
+			environ = env(environ, "FLEXDEV_SOCKET", b.socket)
+		}
+	}
+
+	vars, err := appEnv(b.slot, b.config)
+	if err != nil {
+		return fmt.Errorf("Could not read environment: %v", err)
+	}
+	for k, v := range vars {
+		environ = env(environ, k, v.Value)
 	}
+	cmd := exec.Command("/bin/sh", "-c", wrapper+`exec "$0"`, "./flexdev-server")
+	cmd.ExtraFiles = files
+	cmd.Dir = b.dir
+	cmd.Stdout, cmd.Stderr = b.logs.Writer(flexdev.StreamStdout), b.logs.Writer(flexdev.StreamStderr)
 	cmd.Env = environ
 	b.cmd = cmd
 
 	if err := cmd.Start(); err != nil {
 		return err
 	}
+	b.exit = ""
+	b.starts++
+	b.cgroup = cgroup
 	b.State = flexdev.StateRunning
+	b.logs.Printf(flexdev.StreamSupervisor, "Started app (pid %d, limits: %v).", cmd.Process.Pid, b.config.Flexdev.Limits)
+	appStarts.add(1, b.slot.name)
+	go b.wait(cmd)
+	switch {
+	case b.socket != "":
+		go timeStart(b.slot.name, start, "unix", b.socket)
+	case h != nil:
+		go h.probe(b.slot.name, start)
+	default:
+		go timeStart(b.slot.name, start, "tcp", b.addr)
+	}
 
 	return nil
 }
 
+// wait reaps the app process and records why it exited, unless it was
+// stopped on purpose or replaced in the meantime.
+func (b *Build) wait(cmd *exec.Cmd) {
+	err := cmd.Wait()
+	b.logs.Flush()
+
+	b.slot.mu.Lock()
+	defer b.slot.mu.Unlock()
+	defer b.slot.publish()
+	if b.cmd != cmd || b.State != flexdev.StateRunning {
+		b.logs.Printf(flexdev.StreamSupervisor, "App stopped (pid %d).", cmd.Process.Pid)
+		return
+	}
+	if err == nil {
+		b.exit = "app exited"
+	} else {
+		b.exit = fmt.Sprintf("app exited: %v", err)
+	}
+	log.Print(b.exit)
+	b.logs.Add(flexdev.StreamSupervisor, b.exit)
+	appExits.add(1, b.slot.name)
+	b.State = flexdev.StateStopped
+}
+
+// listen creates the listener handed to the app, according to the
+// listener setting. It returns a nil listener in "port" mode, where the app
+// binds $PORT itself.
+func (b *Build) listen() (filer, error) {
+	b.socket = ""
+	b.transport = nil
+	switch b.config.Flexdev.Listener {
+	case listenerPort:
+		return nil, nil
+	case "", listenerInherit:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		b.addr = l.Addr().String()
+		return l.(*net.TCPListener), nil
+	case listenerUnix:
+		// Outside the build dir, which is listed on each deploy.
+		if err := os.MkdirAll(runDir, 0700); err != nil {
+			return nil, err
+		}
+		b.socket = filepath.Join(runDir, b.slot.name+".sock")
+		if err := os.Remove(b.socket); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: b.socket, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		// The socket file must outlive our copy of the listener.
+		l.SetUnlinkOnClose(false)
+		b.addr = "flexdev.sock"
+		socket := b.socket
+		b.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("Unknown listener %q. Want one of %q, %q or %q.", b.config.Flexdev.Listener, listenerPort, listenerInherit, listenerUnix)
+}
+
+type filer interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+func reservePort() (host, port string, err error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return "", "", err
+	}
+	defer l.Close()
+	return net.SplitHostPort(l.Addr().String())
+}
+
 func (b *Build) Stop() error {
 	if b.State != flexdev.StateRunning {
 		return errors.New("Tried to stop binary when not running")
@@ -101,6 +275,7 @@ func (b *Build) Stop() error {
 		b.State = flexdev.StateStopped
 		return errors.New("Tried to stop binary when process not running")
 	}
+	b.logs.Printf(flexdev.StreamSupervisor, "Stopping app (pid %d).", b.cmd.Process.Pid)
 	if err := b.cmd.Process.Kill(); err != nil {
 		return err
 	}
@@ -142,7 +317,99 @@ func env(env []string, k, v string) []string {
 }
 
 type config struct {
-	Runtime string            `yaml:"runtime"`
-	VM      string            `yaml:"vm"`
-	Env     map[string]string `yaml:"env_variables"`
+	Runtime           string            `yaml:"runtime"`
+	VM                string            `yaml:"vm"`
+	Env               map[string]string `yaml:"env_variables"`
+	DefaultExpiration string            `yaml:"default_expiration"`
+	Handlers          []handler         `yaml:"handlers"`
+	Flexdev           settings          `yaml:"flexdev"`
+}
+
+func (c *config) parse() error {
+	if err := c.parseHandlers(); err != nil {
+		return err
+	}
+	return c.Flexdev.parse()
 }
+
+// settings are flexdev-only options, read from the "flexdev" section of the
+// uploaded config. gcloud rejects unknown sections, so keep them in a yaml
+// file used only with flexdev.
+type settings struct {
+	// Listener selects how the app receives connections:
+	//   inherit: the app inherits a bound TCP listener as fd 3
+	//            (LISTEN_FDS=1), or binds $PORT, an unused port, if it
+	//            doesn't support that (default).
+	//   port:    the app binds $PORT itself.
+	//   unix:    the app inherits a unix socket listener as fd 3;
+	//            $FLEXDEV_SOCKET is set to its path. $PORT is set to an
+	//            unused port, but the proxy won't use it.
+	Listener string `yaml:"listener"`
+
+	Limits limits `yaml:"limits"`
+
+	// HoldRequests makes the proxy hold requests while a new build is on its
+	// way to running, instead of failing them straight away.
+	HoldRequests holdSettings `yaml:"hold_requests"`
+
+	// CaptureRequests records recent requests and responses going through
+	// the proxy, for `flexdev requests` and `flexdev replay`.
+	CaptureRequests captureSettings `yaml:"capture_requests"`
+
+	// Headers says what request headers the proxy sends on to the app.
+	Headers headerSettings `yaml:"headers"`
+
+	// LiveReload adds a script to HTML responses that reloads the page when
+	// a new build starts running.
+	LiveReload bool `yaml:"live_reload"`
+
+	Logs struct {
+		MaxLines int    `yaml:"max_lines"`
+		MaxSize  string `yaml:"max_size"`
+
+		maxSize int64
+	} `yaml:"logs"`
+
+	// Redact masks secrets in status, logs and error pages.
+	Redact redactSettings `yaml:"redact"`
+
+	// ErrorPage says who sees build output on the page shown while the app
+	// isn't running: "public" (default) for anyone, or "admins" for those
+	// with access to the flexdev server.
+	ErrorPage string `yaml:"error_page"`
+}
+
+func (s *settings) parse() error {
+	if err := s.Limits.parse(); err != nil {
+		return err
+	}
+	if err := s.CaptureRequests.parse(); err != nil {
+		return err
+	}
+	if err := s.Headers.parse(); err != nil {
+		return err
+	}
+	if err := s.Redact.parse(); err != nil {
+		return err
+	}
+	switch s.ErrorPage {
+	case "", errorPagePublic, errorPageAdmins:
+	default:
+		return fmt.Errorf("Unknown error_page %q. Want %q or %q.", s.ErrorPage, errorPagePublic, errorPageAdmins)
+	}
+	s.Logs.maxSize = 0
+	if s.Logs.MaxSize != "" {
+		n, err := flexdev.ParseSize(s.Logs.MaxSize)
+		if err != nil {
+			return fmt.Errorf("Bad log size: %v", err)
+		}
+		s.Logs.maxSize = n
+	}
+	return nil
+}
+
+const (
+	listenerPort    = "port"
+	listenerInherit = "inherit"
+	listenerUnix    = "unix"
+)
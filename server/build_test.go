@@ -0,0 +1,47 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnixSocketOutsideBuildDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	oldRunDir := runDir
+	runDir = filepath.Join(tmp, "run")
+	defer func() { runDir = oldRunDir }()
+
+	dir := filepath.Join(tmp, "build")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := &Build{
+		slot:   newSlot("sock"),
+		dir:    dir,
+		config: testConfig(t, "runtime: go\nflexdev:\n  listener: unix"),
+	}
+	l, err := b.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if strings.HasPrefix(b.socket, dir+string(filepath.Separator)) {
+		t.Errorf("socket %s is in the build dir", b.socket)
+	}
+
+	// The next deploy lists the build dir.
+	if _, _, err := b.filesNeeded(); err != nil {
+		t.Errorf("filesNeeded: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+type captureSettings struct {
+	MaxRequests int    `yaml:"max_requests"` // 0 disables capture.
+	MaxBody     string `yaml:"max_body"`     // Per body. Defaults to 64K.
+
+	maxBody int64
+}
+
+const defaultCaptureBody = 64 << 10
+
+func (s *captureSettings) parse() error {
+	s.maxBody = defaultCaptureBody
+	if s.MaxBody != "" {
+		n, err := flexdev.ParseSize(s.MaxBody)
+		if err != nil {
+			return fmt.Errorf("Bad capture body size: %v", err)
+		}
+		s.maxBody = n
+	}
+	return nil
+}
+
+var captured = &captureStore{}
+
+// captureStore holds the most recent requests, oldest first.
+type captureStore struct {
+	mu     sync.Mutex
+	reqs   []*capturedRequest
+	nextID int
+}
+
+// capturedRequest is a request as viewers see it, with credentials and
+// secrets masked, and the headers and body it came with, to replay it with.
+type capturedRequest struct {
+	flexdev.CapturedRequest
+	header http.Header
+	body   []byte
+}
+
+// credentialHeaders are masked in captured requests, along with headers whose
+// names look secret.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", flexdev.UploadTokenHeader}
+
+// redactHeader returns a copy of h with credentials masked.
+func redactHeader(h http.Header) http.Header {
+	c := cloneHeader(h)
+	for k, v := range c {
+		if matchHeader(credentialHeaders, k) || flexdev.IsSecretName(strings.Replace(k, "-", "_", -1)) {
+			for i := range v {
+				v[i] = flexdev.Redacted
+			}
+		}
+	}
+	return c
+}
+
+func (s *captureStore) add(c *capturedRequest, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	c.ID = strconv.Itoa(s.nextID)
+	s.reqs = append(s.reqs, c)
+	if len(s.reqs) > max {
+		s.reqs = append([]*capturedRequest(nil), s.reqs[len(s.reqs)-max:]...)
+	}
+}
+
+func (s *captureStore) get(id string) *capturedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.reqs {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *captureStore) list() []flexdev.CapturedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make([]flexdev.CapturedRequest, len(s.reqs))
+	for i, c := range s.reqs {
+		l[i] = c.CapturedRequest
+	}
+	return l
+}
+
+// capture proxies r with serve, recording the request and response if the
+// build asks for it.
+func capture(v view, w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	s := v.build.config.Flexdev.CaptureRequests
+	if s.MaxRequests <= 0 {
+		serve(w, r)
+		return
+	}
+
+	c := &capturedRequest{
+		CapturedRequest: flexdev.CapturedRequest{
+			ReplayOf: r.Header.Get(flexdev.ReplayHeader),
+			Slot:     v.slot.name,
+			Build:    v.build.ID,
+			Time:     time.Now(),
+			Method:   r.Method,
+			URL:      r.URL.RequestURI(),
+			Host:     r.Host,
+			Header:   redactHeader(r.Header),
+		},
+		header: cloneHeader(r.Header),
+	}
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.maxBody+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		c.body, c.BodyTruncated = truncate(body, s.maxBody)
+	}
+	red := v.build.redactor()
+	c.Body = redactBody(red, c.body)
+
+	cw := &captureWriter{ResponseWriter: w, max: s.maxBody}
+	serve(cw, r)
+
+	c.Duration = time.Since(c.Time)
+	c.Status = cw.status
+	if c.Status == 0 {
+		c.Status = http.StatusOK
+	}
+	c.ResponseHeader = redactHeader(w.Header())
+	c.ResponseBody, c.ResponseBodyTruncated = truncate(cw.body.Bytes(), s.maxBody)
+	c.ResponseBody = redactBody(red, c.ResponseBody)
+	captured.add(c, s.MaxRequests)
+}
+
+// redactBody masks secrets in a captured body.
+func redactBody(red *flexdev.Redactor, b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	return []byte(red.Redact(string(b)))
+}
+
+func truncate(b []byte, max int64) ([]byte, bool) {
+	if int64(len(b)) > max {
+		return b[:max], true
+	}
+	return b, false
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// captureWriter records the status and the start of the body written to it.
+type captureWriter struct {
+	http.ResponseWriter
+	max    int64
+	status int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if rest := w.max + 1 - int64(w.body.Len()); rest > 0 {
+		if int64(len(b)) < rest {
+			rest = int64(len(b))
+		}
+		w.body.Write(b[:rest])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, rw, err := hijack(w.ResponseWriter)
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return c, rw, err
+}
+
+func requestsHandler(w http.ResponseWriter, r *http.Request) {
+	if id := r.FormValue("id"); id != "" {
+		c := captured.get(id)
+		if c == nil {
+			Response{Code: http.StatusNotFound, Error: fmt.Errorf("No captured request %s.", id)}.WriteTo(w)
+			return
+		}
+		Response{Requests: []flexdev.CapturedRequest{c.CapturedRequest}}.WriteTo(w)
+		return
+	}
+	l := captured.list()
+	if r.FormValue("bodies") == "" {
+		for i := range l {
+			l[i].Body, l[i].ResponseBody = nil, nil
+		}
+	}
+	Response{Requests: l}.WriteTo(w)
+}
+
+// replayHandler sends a captured request through the proxy again, to whatever
+// build is current. It is sent with the credentials it came with, which the
+// deployer replaying it never sees.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if id == "" {
+		Response{Code: http.StatusBadRequest, Error: errors.New("Missing request ID.")}.WriteTo(w)
+		return
+	}
+	c := captured.get(id)
+	if c == nil {
+		Response{Code: http.StatusNotFound, Error: fmt.Errorf("No captured request %s.", id)}.WriteTo(w)
+		return
+	}
+	if c.BodyTruncated {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Request %s body was truncated, can't replay it.", id)}.WriteTo(w)
+		return
+	}
+
+	req, err := http.NewRequest(c.Method, c.URL, bytes.NewReader(c.body))
+	if err != nil {
+		Response{Error: fmt.Errorf("Could not recreate request: %v", err)}.WriteTo(w)
+		return
+	}
+	req = req.WithContext(r.Context())
+	req.Header = cloneHeader(c.header)
+	req.Header.Set(flexdev.ReplayHeader, c.ID)
+	if c.Slot != "" {
+		req.Header.Set(flexdev.SlotHeader, c.Slot)
+	}
+	req.Host = c.Host
+	req.RemoteAddr = r.RemoteAddr
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, req)
+	audit(r, flexdev.AuditEvent{Action: "replay", Slot: c.Slot, Details: fmt.Sprintf("request %s: %s %s -> %d", c.ID, c.Method, c.URL, rec.Code)})
+
+	res := flexdev.CapturedRequest{
+		ReplayOf:       c.ID,
+		Slot:           c.Slot,
+		Time:           start,
+		Duration:       time.Since(start),
+		Method:         c.Method,
+		URL:            c.URL,
+		Host:           c.Host,
+		Status:         rec.Code,
+		ResponseHeader: redactHeader(rec.Header()),
+	}
+	red := (&Build{}).redactor()
+	if s, err := getSlot(c.Slot, false); err == nil {
+		if v, _ := s.currentView(); v.build != nil {
+			res.Build = v.build.ID
+			red = v.build.redactor()
+		}
+	}
+	res.ResponseBody = redactBody(red, rec.Body.Bytes())
+	Response{
+		Message:  fmt.Sprintf("Replayed request %s: %d %s", c.ID, rec.Code, http.StatusText(rec.Code)),
+		Requests: []flexdev.CapturedRequest{res},
+	}.WriteTo(w)
+}
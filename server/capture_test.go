@@ -0,0 +1,124 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func TestCaptureRedactsCredentials(t *testing.T) {
+	old := captured
+	captured = &captureStore{}
+	defer func() { captured = old }()
+
+	got := make(chan http.Header, 2)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cr3tsession"})
+	}))
+	defer app.Close()
+	_, done := testSlot(t, "capture", app, testConfig(t, "runtime: go\nflexdev:\n  capture_requests:\n    max_requests: 10"))
+	defer done()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(flexdev.SlotHeader, "capture")
+	r.Header.Set("Authorization", "Bearer abc.def")
+	r.Header.Set("Cookie", "session=s3cr3tsession")
+	r.Header.Set("X-Api-Key", "k3y")
+	r.Header.Set("Accept", "text/html")
+	proxyHandler(httptest.NewRecorder(), r)
+	<-got
+
+	l := captured.list()
+	if len(l) != 1 {
+		t.Fatalf("captured %d requests, want 1", len(l))
+	}
+	c := l[0]
+	for k, want := range map[string]string{
+		"Authorization": flexdev.Redacted,
+		"Cookie":        flexdev.Redacted,
+		"X-Api-Key":     flexdev.Redacted,
+		"Accept":        "text/html",
+	} {
+		if got := c.Header.Get(k); got != want {
+			t.Errorf("captured %s = %q, want %q", k, got, want)
+		}
+	}
+	if got := c.ResponseHeader.Get("Set-Cookie"); got != flexdev.Redacted {
+		t.Errorf("captured Set-Cookie = %q, want %q", got, flexdev.Redacted)
+	}
+
+	// Replays still send the credentials.
+	w := httptest.NewRecorder()
+	replayHandler(w, httptest.NewRequest("POST", "/_flexdev/requests/replay?id="+c.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay: %d %s", w.Code, w.Body)
+	}
+	if h := <-got; h.Get("Authorization") != "Bearer abc.def" || h.Get("Cookie") != "session=s3cr3tsession" {
+		t.Errorf("replay sent Authorization %q, Cookie %q", h.Get("Authorization"), h.Get("Cookie"))
+	}
+}
+
+func TestCaptureRedactsBodies(t *testing.T) {
+	old := captured
+	captured = &captureStore{}
+	defer func() { captured = old }()
+
+	got := make(chan string, 2)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- string(b)
+		fmt.Fprint(w, `{"api_key": "k3yk3yk3y", "db": "hunter22"}`)
+	}))
+	defer app.Close()
+	_, done := testSlot(t, "capture-body", app, testConfig(t, "runtime: go\nenv_variables:\n  DB_PASSWORD: hunter22\nflexdev:\n  capture_requests:\n    max_requests: 10"))
+	defer done()
+
+	r := httptest.NewRequest("POST", "/login", strings.NewReader("user=a&password=s3cr3tpass"))
+	r.Header.Set(flexdev.SlotHeader, "capture-body")
+	proxyHandler(httptest.NewRecorder(), r)
+	<-got
+
+	w := httptest.NewRecorder()
+	requestsHandler(w, httptest.NewRequest("GET", "/_flexdev/requests?bodies=1", nil))
+	var resp struct{ Requests []flexdev.CapturedRequest }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Requests) != 1 {
+		t.Fatalf("requests: %v %s", err, w.Body)
+	}
+	shown := string(resp.Requests[0].Body) + string(resp.Requests[0].ResponseBody)
+	for _, secret := range []string{"s3cr3tpass", "k3yk3yk3y", "hunter22"} {
+		if strings.Contains(shown, secret) {
+			t.Errorf("requests show %q: %s", secret, shown)
+		}
+	}
+
+	// Replays still send the body as it came.
+	l := captured.list()
+	if len(l) != 1 {
+		t.Fatalf("captured %d requests, want 1", len(l))
+	}
+	w = httptest.NewRecorder()
+	replayHandler(w, httptest.NewRequest("POST", "/_flexdev/requests/replay?id="+l[0].ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay: %d %s", w.Code, w.Body)
+	}
+	if b := <-got; b != "user=a&password=s3cr3tpass" {
+		t.Errorf("replay sent body %q", b)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Requests) != 1 {
+		t.Fatalf("replay: %v %s", err, w.Body)
+	}
+	if b := string(resp.Requests[0].ResponseBody); strings.Contains(b, "hunter22") {
+		t.Errorf("replay response shows the secret: %s", b)
+	}
+}
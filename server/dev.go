@@ -0,0 +1,154 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+var devConfig = flag.String("dev", "", "Path to an app.yaml. Deploy the app it is in to the default slot from the local disk, again whenever its files change, and print its logs.")
+
+// How often the dev app's files are checked for changes.
+const devPoll = time.Second
+
+// devLoop deploys the app configured in yamlFile whenever its files change.
+// Files are copied to the build rather than uploaded, but are otherwise
+// handled as `flexdev deploy` would have them.
+func devLoop(yamlFile string) {
+	s, err := getSlot(flexdev.DefaultSlot, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	root := filepath.Dir(yamlFile)
+	var last, lastErr string
+	for ; ; time.Sleep(devPoll) {
+		files, err := flexdev.ListDir(root)
+		if err == nil {
+			files, err = files.Clean()
+		}
+		if err != nil {
+			if err.Error() != lastErr {
+				log.Printf("Could not list %s: %v", root, err)
+			}
+			lastErr = err.Error()
+			continue
+		}
+		lastErr = ""
+		hash := files.TreeHash()
+		if hash == last {
+			continue
+		}
+		last = hash
+		if err := devDeploy(s, yamlFile, files); err != nil {
+			log.Printf("Could not deploy: %v", err)
+		}
+	}
+}
+
+// devDeploy builds and starts files, which are in the same directory as
+// yamlFile, in s.
+func devDeploy(s *slot, yamlFile string, files flexdev.DirList) error {
+	b, err := ioutil.ReadFile(yamlFile)
+	if err != nil {
+		return err
+	}
+	var config config
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("Could not parse yaml config: %v", err)
+	}
+	if err := config.parse(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
+
+	if s.build != nil && s.build.State == flexdev.StateRunning {
+		if err := s.build.Stop(); err != nil {
+			return fmt.Errorf("Could not stop existing binary: %v", err)
+		}
+	}
+	build, err := s.createBuild(files, &config)
+	if err != nil {
+		return err
+	}
+	sums := map[string]string{}
+	for _, e := range files {
+		sums[e.Path] = e.SHA1
+	}
+	root := filepath.Dir(yamlFile)
+	for _, f := range build.manifest.Missing() {
+		size, err := build.manifest.Check(f, sums[f])
+		if err != nil {
+			return fmt.Errorf("Could not copy %s: %v", f, err)
+		}
+		if err := devCopy(build, root, f, size, sums[f]); err != nil {
+			return fmt.Errorf("Could not copy %s: %v", f, err)
+		}
+		build.manifest.Received(f)
+	}
+	if err := build.GoBuild(); err != nil {
+		return fmt.Errorf("Build failed: %v", err)
+	}
+	if err := build.Start(); err != nil {
+		return fmt.Errorf("Could not run binary: %v", err)
+	}
+	return nil
+}
+
+func devCopy(b *Build, root, f string, size int64, sum string) error {
+	src, err := flexdev.JoinPath(root, f)
+	if err != nil {
+		return err
+	}
+	dest, err := flexdev.JoinPath(b.dir, f)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = writeUpload(dest, r, size, sum)
+	return err
+}
+
+// printLogs prints the logs of s's builds as they come, moving on to each new
+// build.
+func printLogs(s *slot) {
+	var b *Build
+	var q flexdev.LogQuery
+	for {
+		v, viewChanged := s.currentView()
+		if v.build != b {
+			b, q = v.build, flexdev.LogQuery{}
+		}
+		if b == nil {
+			<-viewChanged
+			continue
+		}
+		lines, changed := b.logs.Wait(q)
+		for _, l := range lines {
+			fmt.Printf("%s %-10s %s\n", l.Time.Local().Format("15:04:05.000"), l.Stream, l.Text)
+			q.AfterSeq = l.Seq
+		}
+		select {
+		case <-changed:
+		case <-viewChanged:
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// stateDir holds server state that must survive new builds.
+var stateDir = filepath.Join(os.TempDir(), "flexdev-state")
+
+var serverEnv = &envStore{path: filepath.Join(stateDir, "env.json"), source: "server"}
+
+var (
+	slotEnvsMu sync.Mutex
+	slotEnvs   = map[string]*envStore{}
+)
+
+// slotEnv returns the variables set for the named slot only, with `flexdev
+// env set -slot`.
+func slotEnv(name string) *envStore {
+	slotEnvsMu.Lock()
+	defer slotEnvsMu.Unlock()
+	s := slotEnvs[name]
+	if s == nil {
+		s = &envStore{path: filepath.Join(stateDir, "env", name+".json"), source: "slot"}
+		slotEnvs[name] = s
+	}
+	return s
+}
+
+// envStore holds environment variables set with `flexdev env set`. They are
+// applied over the config's env_variables when the app starts.
+type envStore struct {
+	path   string
+	source string // The Source of its variables.
+
+	mu     sync.Mutex
+	vars   map[string]flexdev.EnvVar
+	loaded bool
+}
+
+func (s *envStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.vars = make(map[string]flexdev.EnvVar)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &s.vars); err != nil {
+		return fmt.Errorf("Could not read %s: %v", s.path, err)
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *envStore) save() error {
+	b, err := json.Marshal(s.vars)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *envStore) set(v flexdev.EnvVar) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	v.Source = s.source
+	s.vars[v.Name] = v
+	return s.save()
+}
+
+// unset reports whether name was set.
+func (s *envStore) unset(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if _, ok := s.vars[name]; !ok {
+		return false, nil
+	}
+	delete(s.vars, name)
+	return true, s.save()
+}
+
+func (s *envStore) all() (map[string]flexdev.EnvVar, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]flexdev.EnvVar, len(s.vars))
+	for k, v := range s.vars {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// appEnv returns the environment variables of the app in s: the config's
+// env_variables, overridden by those set on the server, overridden by those
+// set for s.
+func appEnv(s *slot, c *config) (map[string]flexdev.EnvVar, error) {
+	vars, err := serverEnv.all()
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		own, err := slotEnv(s.name).all()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range own {
+			vars[k] = v
+		}
+	}
+	if c == nil {
+		return vars, nil
+	}
+	for k, v := range c.Env {
+		if _, ok := vars[k]; !ok {
+			vars[k] = flexdev.EnvVar{Name: k, Value: v, Source: "app.yaml"}
+		}
+	}
+	return vars, nil
+}
+
+func envListHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusNotFound, Error: err}.WriteTo(w)
+		return
+	}
+	v, _ := s.currentView()
+	var c *config
+	var red redactSettings
+	if v.build != nil && v.build.config != nil {
+		c = v.build.config
+		red = c.Flexdev.Redact
+	}
+	vars, err := appEnv(s, c)
+	if err != nil {
+		Response{Error: err}.WriteTo(w)
+		return
+	}
+
+	// Mask what status and logs would, not just values set as secret.
+	list := make([]flexdev.EnvVar, 0, len(vars))
+	for _, e := range vars {
+		if red.secret(e) {
+			e.Value = flexdev.Redacted
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	Response{Env: list}.WriteTo(w)
+}
+
+// envTarget returns the store to change for r: the one of the slot it names,
+// or the server's, and the slots whose apps it affects.
+func envTarget(r *http.Request) (*envStore, []*slot, error) {
+	name := r.URL.Query().Get("slot")
+	if name == "" {
+		return serverEnv, allSlots(), nil
+	}
+	if err := flexdev.CheckSlotName(name); err != nil {
+		return nil, nil, err
+	}
+	var affected []*slot
+	if s, err := getSlot(name, false); err == nil {
+		affected = append(affected, s)
+	}
+	return slotEnv(name), affected, nil
+}
+
+// envSetHandler takes the variables as a JSON list in the body, so values
+// don't end up in request logs.
+func envSetHandler(w http.ResponseWriter, r *http.Request) {
+	store, affected, err := envTarget(r)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	var vars []flexdev.EnvVar
+	if err := json.NewDecoder(r.Body).Decode(&vars); err != nil {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Could not read variables: %v", err)}.WriteTo(w)
+		return
+	}
+	if len(vars) == 0 {
+		Response{Code: http.StatusBadRequest, Error: errors.New("No variables to set.")}.WriteTo(w)
+		return
+	}
+	for _, v := range vars {
+		if err := flexdev.CheckEnvName(v.Name); err != nil {
+			Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+			return
+		}
+	}
+	for _, v := range vars {
+		err := store.set(v)
+		audit(r, flexdev.AuditEvent{Action: "env.set", Slot: r.URL.Query().Get("slot"), Details: v.Name, Outcome: outcome(err)})
+		if err != nil {
+			Response{Error: fmt.Errorf("Could not set %s: %v", v.Name, err)}.WriteTo(w)
+			return
+		}
+	}
+	restartForEnv(w, fmt.Sprintf("Set %d variable(s).", len(vars)), affected)
+}
+
+func envUnsetHandler(w http.ResponseWriter, r *http.Request) {
+	store, affected, err := envTarget(r)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	r.ParseForm()
+	names := r.Form["name"]
+	if len(names) == 0 {
+		Response{Code: http.StatusBadRequest, Error: errors.New("No variables to unset.")}.WriteTo(w)
+		return
+	}
+	n := 0
+	for _, name := range names {
+		ok, err := store.unset(name)
+		if ok || err != nil {
+			audit(r, flexdev.AuditEvent{Action: "env.unset", Slot: r.URL.Query().Get("slot"), Details: name, Outcome: outcome(err)})
+		}
+		if err != nil {
+			Response{Error: fmt.Errorf("Could not unset %s: %v", name, err)}.WriteTo(w)
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	if n == 0 {
+		Response{Message: "Nothing to unset."}.WriteTo(w)
+		return
+	}
+	restartForEnv(w, fmt.Sprintf("Unset %d variable(s).", n), affected)
+}
+
+// restartForEnv restarts the running apps in the affected slots, so that they
+// pick up env changes.
+func restartForEnv(w http.ResponseWriter, msg string, affected []*slot) {
+	n := 0
+	for _, s := range affected {
+		ok, err := s.restartForEnv()
+		if err != nil {
+			Response{Error: fmt.Errorf("%s Could not restart slot %s: %v", msg, s.name, err)}.WriteTo(w)
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	if n > 0 {
+		msg += fmt.Sprintf(" Restarted %d app(s).", n)
+	}
+	Response{Message: msg}.WriteTo(w)
+}
+
+func (s *slot) restartForEnv() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
+
+	if s.build == nil || s.build.State != flexdev.StateRunning {
+		return false, nil
+	}
+	log.Printf("Restarting app in slot %s for new environment.", s.name)
+	if err := s.build.Stop(); err != nil {
+		return false, fmt.Errorf("Could not stop binary: %v", err)
+	}
+	if err := s.build.Start(); err != nil {
+		return false, fmt.Errorf("Could not run binary: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func TestSlotEnv(t *testing.T) {
+	app := httptest.NewServer(nil)
+	defer app.Close()
+	a, doneA := testSlot(t, "env-a", app, testConfig(t, "runtime: go\nenv_variables:\n  NAME: yaml\n  MODE: yaml"))
+	defer doneA()
+	b, doneB := testSlot(t, "env-b", app, testConfig(t, "runtime: go\nenv_variables:\n  NAME: yaml"))
+	defer doneB()
+	// No app to restart.
+	a.build.State, b.build.State = flexdev.StateStopped, flexdev.StateStopped
+
+	set := func(query, body string) {
+		w := httptest.NewRecorder()
+		envSetHandler(w, httptest.NewRequest("POST", "/_flexdev/env/set"+query, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("env set%s: %d %s", query, w.Code, w.Body)
+		}
+	}
+	set("", `[{"Name": "NAME", "Value": "server"}, {"Name": "MODE", "Value": "server"}]`)
+	set("?slot=env-a", `[{"Name": "NAME", "Value": "a"}]`)
+	defer serverEnv.unset("NAME")
+	defer serverEnv.unset("MODE")
+
+	for _, tt := range []struct {
+		s                *slot
+		name, mode, from string
+	}{
+		{a, "a", "server", "slot"},
+		{b, "server", "server", "server"},
+	} {
+		vars, err := appEnv(tt.s, tt.s.build.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vars["NAME"].Value != tt.name || vars["MODE"].Value != tt.mode || vars["NAME"].Source != tt.from {
+			t.Errorf("slot %s: NAME=%+v MODE=%+v, want NAME=%s from %s, MODE=%s", tt.s.name, vars["NAME"], vars["MODE"], tt.name, tt.from, tt.mode)
+		}
+	}
+
+	_, affected, err := envTarget(httptest.NewRequest("POST", "/_flexdev/env/set?slot=env-a", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(affected) != 1 || affected[0] != a {
+		t.Errorf("env set -slot=env-a affects %d slots, want only env-a", len(affected))
+	}
+	if _, _, err := envTarget(httptest.NewRequest("POST", "/_flexdev/env/set?slot=../x", nil)); err == nil {
+		t.Error("bad slot name accepted")
+	}
+}
+
+func TestEnvListMasksSecrets(t *testing.T) {
+	app := httptest.NewServer(nil)
+	defer app.Close()
+	_, done := testSlot(t, "env-list", app, testConfig(t, `runtime: go
+env_variables:
+  PLAIN: visible
+  DB_PASSWORD: hunter22
+  STRIPE: sk_test_abcdef
+flexdev:
+  redact:
+    keys: ["STRI*"]`))
+	defer done()
+
+	w := httptest.NewRecorder()
+	envListHandler(w, httptest.NewRequest("GET", "/_flexdev/env/list?slot=env-list", nil))
+	var resp struct{ Env []flexdev.EnvVar }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	want := map[string]string{"PLAIN": "visible", "DB_PASSWORD": flexdev.Redacted, "STRIPE": flexdev.Redacted}
+	for _, v := range resp.Env {
+		if w, ok := want[v.Name]; ok && v.Value != w {
+			t.Errorf("%s = %q, want %q", v.Name, v.Value, w)
+		}
+	}
+}
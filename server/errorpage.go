@@ -0,0 +1,244 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// Lines of source shown around a compile error.
+const sourceContext = 3
+
+// serveUnavailable tells the client why the app isn't running: an HTML page
+// for browsers, JSON for clients asking for it, and plain text otherwise.
+// Secrets are masked, and build output is left out for those who may not see
+// it.
+func serveUnavailable(w http.ResponseWriter, r *http.Request, v view) {
+	show := showBuildOutput(r, v)
+	p := newErrorPage(v, show)
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/html"):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := errorPageTmpl.Execute(w, p); err != nil {
+			fmt.Fprintf(w, "Could not render error page: %v", err)
+		}
+	case strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(p)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if v.build == nil {
+			fmt.Fprintf(w, "No app to run. Use `flexdev deploy` to deploy the application code.")
+			return
+		}
+		fmt.Fprintf(w, "state: %s\n", v.state)
+		if !show {
+			fmt.Fprintln(w, hiddenOutput)
+			return
+		}
+		fmt.Fprintf(w, "%s", v.build.redactor().Redact(v.build.logs.String(flexdev.LogQuery{})))
+	}
+}
+
+type errorPage struct {
+	Slot   string      `json:"slot"`
+	Build  string      `json:"build,omitempty"`
+	State  string      `json:"state"`
+	Errors []pageError `json:"errors,omitempty"`
+	Log    []logLine   `json:"log,omitempty"`
+	Hidden bool        `json:"hidden,omitempty"`
+	Steps  []buildStep `json:"-"`
+}
+
+const hiddenOutput = "Build output is only shown to users of the flexdev server."
+
+type pageError struct {
+	flexdev.CompileError
+	Source []sourceLine `json:"source,omitempty"`
+}
+
+type sourceLine struct {
+	N     int    `json:"n"`
+	Text  string `json:"text"`
+	Error bool   `json:"error,omitempty"`
+}
+
+type logLine struct {
+	Stream flexdev.Stream `json:"stream"`
+	Text   string         `json:"text"`
+}
+
+type buildStep struct {
+	Name       string
+	Done, Here bool
+}
+
+func newErrorPage(v view, show bool) *errorPage {
+	p := &errorPage{Slot: v.slot.name, State: "none"}
+	if v.build == nil {
+		return p
+	}
+	p.Build = v.build.ID
+	p.State = v.state
+
+	order := []string{
+		string(flexdev.StateCreated),
+		string(flexdev.StateFetching),
+		string(flexdev.StateBuilding),
+		string(flexdev.StateBuilt),
+		string(flexdev.StateStarting),
+		string(flexdev.StateRunning),
+	}
+	here := -1
+	for i, s := range order {
+		// A failed build stopped at the building step.
+		if s == v.state || (v.state == string(flexdev.StateFailed) && s == string(flexdev.StateBuilding)) {
+			here = i
+		}
+	}
+	for i, s := range order {
+		p.Steps = append(p.Steps, buildStep{Name: s, Done: i < here, Here: i == here})
+	}
+
+	if !show {
+		p.Hidden = true
+		return p
+	}
+	red := v.build.redactor()
+	buildOut := v.build.logs.String(flexdev.LogQuery{Streams: []flexdev.Stream{flexdev.StreamBuild}})
+	for _, e := range flexdev.ParseCompileErrors(buildOut) {
+		src := readSource(v.build.dir, e.File, e.Line)
+		for i := range src {
+			src[i].Text = red.Redact(src[i].Text)
+		}
+		e.Msg = red.Redact(e.Msg)
+		p.Errors = append(p.Errors, pageError{CompileError: e, Source: src})
+	}
+	for _, l := range v.build.logs.Query(flexdev.LogQuery{Limit: 50}) {
+		p.Log = append(p.Log, logLine{l.Stream, red.Redact(l.Text)})
+	}
+	return p
+}
+
+// readSource returns the lines around line of file, if it is in dir.
+func readSource(dir, file string, line int) []sourceLine {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	if rel, err := filepath.Rel(dir, file); err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var src []sourceLine
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan() && n <= line+sourceContext; n++ {
+		if n >= line-sourceContext {
+			src = append(src, sourceLine{N: n, Text: s.Text(), Error: n == line})
+		}
+	}
+	return src
+}
+
+// stateHandler tells error pages when to reload. It needs no auth, as error
+// pages are shown to anyone visiting the app.
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	v, _ := s.currentView()
+	p := struct {
+		Build string `json:"build,omitempty"`
+		State string `json:"state"`
+	}{State: "none"}
+	if v.build != nil {
+		p.Build, p.State = v.build.ID, v.state
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(p)
+}
+
+var errorPageTmpl = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>flexdev: {{.State}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.steps span { padding: 0.2em 0.6em; margin-right: 0.3em; border-radius: 3px; background: #eee; color: #888; }
+.steps .done { background: #cde8cd; color: #222; }
+.steps .here { background: #fde9a9; color: #222; font-weight: bold; }
+.failed .steps .here { background: #f6c6c6; }
+.error { margin: 1.5em 0; }
+.error h3 { font-family: monospace; font-size: 1em; margin: 0 0 0.3em; }
+.error .msg { color: #b00; white-space: pre-wrap; font-family: monospace; }
+pre { background: #f6f6f6; padding: 0.6em; overflow-x: auto; }
+.src .hit { background: #f6c6c6; display: inline-block; width: 100%; }
+.log .supervisor { color: #555; font-style: italic; }
+.log .stderr { color: #b00; }
+</style>
+</head>
+<body class="{{.State}}">
+<h1>{{if eq .State "failed"}}Build failed{{else if eq .State "none"}}No app deployed{{else}}App is {{.State}}{{end}}</h1>
+{{if eq .State "none"}}<p>Use <code>flexdev deploy</code> to deploy the application code.</p>{{end}}
+{{if .Steps}}<p class="steps">{{range .Steps}}<span class="{{if .Here}}here{{else if .Done}}done{{end}}">{{.Name}}</span>{{end}}</p>{{end}}
+{{range .Errors}}
+<div class="error">
+<h3>{{.File}}:{{.Line}}{{if .Col}}:{{.Col}}{{end}}</h3>
+<div class="msg">{{.Msg}}</div>
+{{if .Source}}<pre class="src">{{range .Source}}<span class="{{if .Error}}hit{{end}}">{{printf "%4d" .N}}  {{.Text}}</span>
+{{end}}</pre>{{end}}
+</div>
+{{end}}
+{{if .Hidden}}<p>Build output is only shown to users of the flexdev server.</p>{{end}}
+{{if .Log}}<h2>Log</h2>
+<pre class="log">{{range .Log}}<span class="{{.Stream}}">{{.Text}}</span>
+{{end}}</pre>{{end}}
+<script>
+(function() {
+	var slot = {{.Slot}}, build = {{.Build}}, state = {{.State}};
+	function poll() {
+		var x = new XMLHttpRequest();
+		x.open("GET", "/_flexdev/state?slot=" + encodeURIComponent(slot));
+		x.onload = function() {
+			try {
+				var s = JSON.parse(x.responseText);
+				if (s.state == "running" || s.build != build || s.state != state) {
+					location.reload();
+					return;
+				}
+			} catch (e) {}
+			setTimeout(poll, 1000);
+		};
+		x.onerror = function() { setTimeout(poll, 2000); };
+		x.send();
+	}
+	setTimeout(poll, 1000);
+})();
+</script>
+</body>
+</html>
+`))
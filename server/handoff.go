@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// handoff finds out whether an app that was handed a listener accepts on it,
+// or binds $PORT instead, as apps that don't support inherited sockets do.
+// The proxy dials whichever the app answers on first.
+type handoff struct {
+	inherited string // Address of the listener handed to the app.
+	port      string // Address of $PORT.
+
+	chosen chan struct{} // Closed once addr is set.
+	addr   string
+}
+
+func newHandoff(inherited, port string) *handoff {
+	return &handoff{inherited: inherited, port: port, chosen: make(chan struct{})}
+}
+
+// dial connects to the address the app answers on, waiting until it is known.
+func (h *handoff) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	select {
+	case <-h.chosen:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", h.addr)
+}
+
+func (h *handoff) choose(addr string) {
+	h.addr = addr
+	close(h.chosen)
+}
+
+// probe waits for an app started at start to answer on either address, and
+// records how long that took. If it answers on neither in time, the proxy
+// uses the inherited listener.
+func (h *handoff) probe(slot string, start time.Time) {
+	for time.Since(start) < startTimeout {
+		if c, err := net.DialTimeout("tcp", h.port, time.Second); err == nil {
+			c.Close()
+			h.choose(h.port)
+			deployPhase.observe(time.Since(start).Seconds(), slot, "start")
+			return
+		}
+		if accepts(h.inherited) {
+			h.choose(h.inherited)
+			deployPhase.observe(time.Since(start).Seconds(), slot, "start")
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	h.choose(h.inherited)
+}
+
+// acceptProbeTimeout is how long accepts waits for the app to take a
+// connection.
+var acceptProbeTimeout = 250 * time.Millisecond
+
+// accepts reports whether the app takes connections from the listener at
+// addr. Connecting succeeds either way, as the kernel completes the handshake
+// for a listener; so it asks for the server's options, which Go's net/http
+// answers without calling a handler, and waits for any reply or hangup.
+func accepts(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(acceptProbeTimeout))
+	if _, err := io.WriteString(c, "OPTIONS * HTTP/1.1\r\nHost: flexdev\r\nConnection: close\r\n\r\n"); err != nil {
+		return false
+	}
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// unusedAddr returns an address nothing listens on.
+func unusedAddr(t *testing.T) string {
+	_, port, err := reservePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func handoffGet(t *testing.T, h *handoff) string {
+	c := &http.Client{Transport: &http.Transport{DialContext: h.dial}, Timeout: 5 * time.Second}
+	resp, err := c.Get("http://app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestHandoffInherited(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("inherited"))
+	}))
+	defer app.Close()
+	h := newHandoff(app.Listener.Addr().String(), unusedAddr(t))
+	go h.probe("handoff", time.Now())
+	if got := handoffGet(t, h); got != "inherited" {
+		t.Errorf("got %q from the app, want inherited", got)
+	}
+}
+
+func TestHandoffPort(t *testing.T) {
+	// The app never accepts on the listener it was handed.
+	ignored, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ignored.Close()
+	port := unusedAddr(t)
+	h := newHandoff(ignored.Addr().String(), port)
+	go h.probe("handoff", time.Now())
+
+	// Requests wait for the app to bind $PORT.
+	bound := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", port)
+		if err != nil {
+			t.Error(err)
+			close(bound)
+			return
+		}
+		bound <- l
+		http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("port"))
+		}))
+	}()
+	defer func() {
+		if l, ok := <-bound; ok {
+			l.Close()
+		}
+	}()
+	if got := handoffGet(t, h); got != "port" {
+		t.Errorf("got %q from the app, want port", got)
+	}
+}
+
+func TestHandoffDialWaits(t *testing.T) {
+	h := newHandoff(unusedAddr(t), unusedAddr(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := h.dial(ctx, "tcp", "app:80"); err != context.DeadlineExceeded {
+		t.Errorf("dial before the app answered: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// headerSettings says what headers the proxy sends to the app.
+type headerSettings struct {
+	// Host is the Host header the app sees: "original" (default) for the one
+	// the client sent, or "app" for the app's own address.
+	Host string `yaml:"host"`
+
+	// TrustedProxies are the addresses, as IPs, CIDR ranges, "loopback" or
+	// "private", of frontends whose X-Forwarded-*, Forwarded and
+	// X-AppEngine-* headers are passed on. From anywhere else, they are
+	// replaced or dropped. Unset, it is "private", which covers App
+	// Engine's frontend; an empty list trusts nobody.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Strip removes request headers matching any of these names, unless they
+	// also match Forward. A trailing * matches any suffix.
+	Strip   []string          `yaml:"strip"`
+	Forward []string          `yaml:"forward"`
+	Add     map[string]string `yaml:"add"`
+
+	trusted []*net.IPNet
+}
+
+// frontendHeaders can only be trusted from a trusted proxy.
+var frontendHeaders = []string{"X-AppEngine-*"}
+
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Prefix"}
+
+// defaultTrustedProxies are trusted if trusted_proxies isn't set.
+var defaultTrustedProxies = []string{"private"}
+
+var namedNets = map[string][]string{
+	"loopback": {"127.0.0.0/8", "::1/128"},
+	"private":  {"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+}
+
+const (
+	hostOriginal = "original"
+	hostApp      = "app"
+)
+
+func (s *headerSettings) parse() error {
+	switch s.Host {
+	case "", hostOriginal, hostApp:
+	default:
+		return fmt.Errorf("Unknown headers.host %q. Want %q or %q.", s.Host, hostOriginal, hostApp)
+	}
+	for _, p := range append(append([]string(nil), s.Strip...), s.Forward...) {
+		if i := strings.Index(p, "*"); p == "" || (i >= 0 && i != len(p)-1) {
+			return fmt.Errorf("Bad header pattern %q. Only a trailing * is allowed.", p)
+		}
+	}
+	for k := range s.Add {
+		if k == "" || strings.ContainsAny(k, " :\r\n") {
+			return fmt.Errorf("Bad header name %q.", k)
+		}
+	}
+	s.trusted = nil
+	proxies := s.TrustedProxies
+	if proxies == nil {
+		proxies = defaultTrustedProxies
+	}
+	for _, p := range proxies {
+		cidrs, ok := namedNets[p]
+		if !ok {
+			cidrs = []string{p}
+			if ip := net.ParseIP(p); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					bits = 8 * net.IPv4len
+				}
+				cidrs = []string{fmt.Sprintf("%s/%d", p, bits)}
+			}
+		}
+		for _, c := range cidrs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("Bad trusted proxy %q. Want an IP, a CIDR range, %q or %q.", p, "loopback", "private")
+			}
+			s.trusted = append(s.trusted, n)
+		}
+	}
+	return nil
+}
+
+// trustedProxy reports whether the client at ip is a trusted proxy.
+func (s headerSettings) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range s.trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHeader(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if len(name) >= len(p)-1 && strings.EqualFold(name[:len(p)-1], p[:len(p)-1]) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// director wraps a proxy's Director to apply s to outgoing requests.
+func (s headerSettings) director(d func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		d(req)
+
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+		us := flexdev.Forwarded{For: client, Host: req.Host, Proto: scheme}
+
+		proto, host := scheme, req.Host
+		forwarded := us.String()
+		if !s.trustedProxy(client) {
+			for _, h := range forwardedHeaders {
+				req.Header.Del(h)
+			}
+			for name := range req.Header {
+				if matchHeader(frontendHeaders, name) {
+					req.Header.Del(name)
+				}
+			}
+		} else {
+			f := strings.Join(req.Header["Forwarded"], ", ")
+			if f != "" {
+				first := flexdev.ParseForwarded(f)[0]
+				if first.Proto != "" {
+					proto = first.Proto
+				}
+				if first.Host != "" {
+					host = first.Host
+				}
+			}
+			if p := firstValue(req.Header.Get("X-Forwarded-Proto")); p != "" {
+				proto = p
+			}
+			if h := firstValue(req.Header.Get("X-Forwarded-Host")); h != "" {
+				host = h
+			}
+			if f != "" {
+				forwarded = f + ", " + forwarded
+			} else if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+				// Describe the earlier hops, which only set X-Forwarded-*.
+				var hops []flexdev.Forwarded
+				for _, ip := range strings.Split(xff, ",") {
+					hops = append(hops, flexdev.Forwarded{For: strings.TrimSpace(ip)})
+				}
+				hops[0].Host, hops[0].Proto = host, proto
+				forwarded = flexdev.FormatForwarded(append(hops, us))
+			}
+		}
+		req.Header.Set("Forwarded", forwarded)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", host)
+		if p, _ := req.Context().Value(prefixKey{}).(string); p != "" {
+			req.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(req.Header.Get("X-Forwarded-Prefix"), "/")+p)
+		}
+
+		for name := range req.Header {
+			if matchHeader(s.Strip, name) && !matchHeader(s.Forward, name) {
+				req.Header.Del(name)
+			}
+		}
+		for k, v := range s.Add {
+			req.Header.Set(k, v)
+		}
+		if s.Host == hostApp {
+			req.Host = ""
+		}
+	}
+}
+
+// firstValue returns the first of a comma-separated list of header values.
+func firstValue(v string) string {
+	if i := strings.Index(v, ","); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
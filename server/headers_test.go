@@ -0,0 +1,149 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// proxiedHeaders sends a request with headers h from remoteAddr through the
+// proxy to an app configured with y, and returns the headers the app saw.
+func proxiedHeaders(t *testing.T, y, remoteAddr string, h http.Header) http.Header {
+	got := make(chan http.Header, 1)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+	}))
+	defer app.Close()
+	_, done := testSlot(t, "headers", app, testConfig(t, y))
+	defer done()
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	r.Header.Set(flexdev.SlotHeader, "headers")
+	w := httptest.NewRecorder()
+	proxyHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	return <-got
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	spoofed := http.Header{
+		"X-Forwarded-For":           {"6.6.6.6"},
+		"X-Forwarded-Proto":         {"https"},
+		"X-Forwarded-Host":          {"bank.example.com"},
+		"Forwarded":                 {"for=6.6.6.6;host=bank.example.com;proto=https"},
+		"X-Appengine-User-Email":    {"admin@example.com"},
+		"X-Appengine-User-Is-Admin": {"1"},
+		"X-Appengine-Country":       {"ZZ"},
+		"X-Forwarded-Prefix":        {"/evil"},
+	}
+	const trusted = "runtime: go\nflexdev:\n  headers:\n    trusted_proxies: [10.0.0.0/8]\n    forward: [X-AppEngine-Country]"
+
+	for _, tt := range []struct {
+		name, config, remote string
+		want                 map[string]string
+	}{
+		{"untrusted", "runtime: go", "203.0.113.9:1234", map[string]string{
+			"X-Forwarded-For":           "203.0.113.9",
+			"X-Forwarded-Proto":         "http",
+			"X-Forwarded-Host":          "app.example.com",
+			"Forwarded":                 "for=203.0.113.9;host=app.example.com;proto=http",
+			"X-Appengine-User-Email":    "",
+			"X-Appengine-User-Is-Admin": "",
+			"X-Appengine-Country":       "",
+			"X-Forwarded-Prefix":        "",
+		}},
+		{"not a trusted proxy", trusted, "203.0.113.9:1234", map[string]string{
+			"X-Forwarded-For":        "203.0.113.9",
+			"X-Forwarded-Host":       "app.example.com",
+			"X-Appengine-User-Email": "",
+			"X-Appengine-Country":    "",
+		}},
+		{"trusted proxy", trusted, "10.1.2.3:1234", map[string]string{
+			"X-Forwarded-For":        "6.6.6.6, 10.1.2.3",
+			"X-Forwarded-Proto":      "https",
+			"X-Forwarded-Host":       "bank.example.com",
+			"Forwarded":              "for=6.6.6.6;host=bank.example.com;proto=https, for=10.1.2.3;host=app.example.com;proto=http",
+			"X-Appengine-User-Email": "admin@example.com",
+			"X-Appengine-Country":    "ZZ",
+			"X-Forwarded-Prefix":     "/evil",
+		}},
+		{"App Engine frontend by default", "runtime: go", "10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Proto":      "https",
+			"X-Appengine-User-Email": "admin@example.com",
+		}},
+		{"nobody trusted", "runtime: go\nflexdev:\n  headers:\n    trusted_proxies: []", "10.1.2.3:1234", map[string]string{
+			"X-Forwarded-Proto":      "http",
+			"X-Appengine-User-Email": "",
+			"X-Forwarded-Prefix":     "",
+		}},
+	} {
+		got := proxiedHeaders(t, tt.config, tt.remote, spoofed)
+		for k, want := range tt.want {
+			if got.Get(k) != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got.Get(k), want)
+			}
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	s := headerSettings{TrustedProxies: []string{"private", "203.0.113.9", "2001:db8::/32"}}
+	if err := s.parse(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"127.0.0.1":    true,
+		"172.17.0.1":   true,
+		"203.0.113.9":  true,
+		"203.0.113.10": false,
+		"2001:db8::1":  true,
+		"8.8.8.8":      false,
+		"bogus":        false,
+	} {
+		if got := s.trustedProxy(ip); got != want {
+			t.Errorf("trustedProxy(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if err := (&headerSettings{TrustedProxies: []string{"everyone"}}).parse(); err == nil {
+		t.Error("parsed bad trusted proxy")
+	}
+}
+
+func TestSlotPrefix(t *testing.T) {
+	got := make(chan http.Header, 1)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+	}))
+	defer app.Close()
+	_, done := testSlot(t, "prefix", app, testConfig(t, "runtime: go"))
+	defer done()
+
+	for remote, want := range map[string]string{
+		"203.0.113.9:1234": "/_slot/prefix",
+		"10.1.2.3:1234":    "/evil/_slot/prefix",
+	} {
+		r := httptest.NewRequest("GET", "http://app.example.com/_slot/prefix/x", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-Prefix", "/evil/")
+		w := httptest.NewRecorder()
+		proxyHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if p := (<-got).Get("X-Forwarded-Prefix"); p != want {
+			t.Errorf("from %s: X-Forwarded-Prefix = %q, want %q", remote, p, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// view is a snapshot of a slot's current build, for the proxy. The proxy can't
+// wait on the slot's lock, which is held for as long as a build takes.
+type view struct {
+	slot      *slot
+	build     *Build
+	builds    []*Build // Most recent builds, oldest first.
+	state     string
+	addr      string
+	transport http.RoundTripper
+	ownPort   bool // The app binds its port itself.
+	starts    int
+	manifest  *flexdev.Manifest
+	pid       int // The running app's.
+	cgroup    string
+}
+
+func (v view) running() bool {
+	return v.build != nil && v.state == string(flexdev.StateRunning)
+}
+
+// inProgress reports whether the build is on its way to running. A build
+// that is still being uploaded is, until the client stops sending files.
+func (v view) inProgress() bool {
+	if v.build == nil {
+		return false
+	}
+	switch v.state {
+	case string(flexdev.StateCreated):
+		return v.manifest != nil && time.Since(v.manifest.Active()) < holdUploadIdle
+	case string(flexdev.StateFetching), string(flexdev.StateBuilding), string(flexdev.StateStarting):
+		return true
+	}
+	return false
+}
+
+// uploadStale returns a channel that receives when a build that is being
+// uploaded stops being in progress, if no file arrives in the meantime.
+func (v view) uploadStale() <-chan time.Time {
+	if v.state != string(flexdev.StateCreated) || v.manifest == nil {
+		return nil
+	}
+	return time.After(time.Until(v.manifest.Active().Add(holdUploadIdle)))
+}
+
+type holdSettings struct {
+	Timeout  time.Duration `yaml:"timeout"`
+	MaxQueue int32         `yaml:"max_queue"`
+}
+
+const defaultHoldQueue = 100
+
+// How long after the last file of an upload requests stop being held.
+var holdUploadIdle = 30 * time.Second
+
+// held is the number of requests currently held.
+var held int32
+
+// hold waits for a build that is in progress to start running, if the build
+// asks for requests to be held. It gives up after the configured timeout, if
+// too many requests are already waiting, or when the build fails.
+func hold(r *http.Request, v view, changed <-chan struct{}) view {
+	if !v.inProgress() {
+		return v
+	}
+	s := v.build.config.Flexdev.HoldRequests
+	if s.Timeout <= 0 {
+		return v
+	}
+	max := s.MaxQueue
+	if max == 0 {
+		max = defaultHoldQueue
+	}
+	if atomic.AddInt32(&held, 1) > max {
+		atomic.AddInt32(&held, -1)
+		return v
+	}
+	defer atomic.AddInt32(&held, -1)
+
+	deadline := time.Now().Add(s.Timeout)
+	timeout := time.NewTimer(s.Timeout)
+	defer timeout.Stop()
+	for v.inProgress() {
+		select {
+		case <-changed:
+			v, changed = v.slot.currentView()
+		case <-v.uploadStale():
+		case <-timeout.C:
+			return v
+		case <-r.Context().Done():
+			return v
+		}
+	}
+	v.waitListening(r.Context(), deadline)
+	return v
+}
+
+// waitListening waits until deadline for a running app to bind its port. The
+// app may not have done so yet if it has only just started.
+func (v view) waitListening(ctx context.Context, deadline time.Time) {
+	if !v.running() || !v.ownPort {
+		return
+	}
+	for time.Now().Before(deadline) {
+		c, err := net.DialTimeout("tcp", v.addr, time.Until(deadline))
+		if err == nil {
+			c.Close()
+			return
+		}
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
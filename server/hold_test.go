@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+const holdConfig = "runtime: go\nflexdev:\n  hold_requests:\n    timeout: 5s"
+
+// holdSlot returns a slot whose build is in b's state.
+func holdSlot(t *testing.T, b flexdev.Build) (*slot, func()) {
+	app := httptest.NewServer(nil)
+	s, done := testSlot(t, "hold-"+string(b.State), app, testConfig(t, holdConfig))
+	s.build.State = b.State
+	s.build.manifest = flexdev.NewManifest(nil, nil)
+	s.publish()
+	return s, func() {
+		done()
+		app.Close()
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	for _, tt := range []struct {
+		b    flexdev.Build
+		want bool
+	}{
+		{flexdev.Build{State: flexdev.StateCreated}, true},
+		{flexdev.Build{State: flexdev.StateFetching}, true},
+		{flexdev.Build{State: flexdev.StateBuilding}, true},
+		{flexdev.Build{State: flexdev.StateStarting}, true},
+		{flexdev.Build{State: flexdev.StateBuilt}, false},
+		{flexdev.Build{State: flexdev.StateFailed}, false},
+		{flexdev.Build{State: flexdev.StateRunning}, false},
+		{flexdev.Build{State: flexdev.StateStopped}, false},
+	} {
+		s, done := holdSlot(t, tt.b)
+		v, _ := s.currentView()
+		if got := v.inProgress(); got != tt.want {
+			t.Errorf("%s: inProgress() = %v, want %v", tt.b.State, got, tt.want)
+		}
+		done()
+	}
+}
+
+func TestHoldStaleUpload(t *testing.T) {
+	old := holdUploadIdle
+	holdUploadIdle = 50 * time.Millisecond
+	defer func() { holdUploadIdle = old }()
+
+	s, done := holdSlot(t, flexdev.Build{State: flexdev.StateCreated})
+	defer done()
+	v, changed := s.currentView()
+	start := time.Now()
+	v = hold(httptest.NewRequest("GET", "/", nil), v, changed)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("held for %v after the upload went stale", d)
+	}
+	if v.inProgress() {
+		t.Error("stale upload still in progress")
+	}
+}
+
+func TestHoldUntilRunning(t *testing.T) {
+	s, done := holdSlot(t, flexdev.Build{State: flexdev.StateBuilding})
+	defer done()
+	v, changed := s.currentView()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.build.State = flexdev.StateRunning
+		s.publish()
+	}()
+	if v = hold(httptest.NewRequest("GET", "/", nil), v, changed); !v.running() {
+		t.Errorf("held until %s, want running", v.state)
+	}
+}
+
+func TestFailedStartLeavesBuilt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, done := holdSlot(t, flexdev.Build{State: flexdev.StateBuilt})
+	defer done()
+	s.build.dir = dir // No binary to run.
+
+	if err := s.build.Start(); err == nil {
+		t.Fatal("Start succeeded without a binary")
+	}
+	if want, got := flexdev.StateBuilt, s.build.State; want != got {
+		t.Errorf("want state %s, got %s", want, got)
+	}
+}
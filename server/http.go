@@ -6,25 +6,24 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"golang.org/x/net/context"
-
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/user"
 
 	"gopkg.in/yaml.v2"
 
@@ -33,52 +32,203 @@ import (
 
 var adminMux = http.NewServeMux()
 
+// auth checks requests to the admin API.
+var auth authenticator
+
 var packageDir = filepath.Join(os.TempDir(), "flexdev-server")
 
 var (
-	buildMu sync.RWMutex
-	build   *Build
+	addr    = flag.String("addr", "", "Address to listen on, when not using App Engine auth. Defaults to :$PORT, or :8080.")
+	workDir = flag.String("dir", "", "Directory to keep builds and server state in. Defaults to the system temp dir.")
 )
 
+// setWorkDir moves builds and server state under dir. It must be called
+// before any slot other than the default one is made.
+func setWorkDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Could not make work dir: %v", err)
+	}
+	packageDir = filepath.Join(dir, "flexdev-server")
+	slotsDir = filepath.Join(dir, "flexdev-slots")
+	runDir = filepath.Join(dir, "flexdev-run")
+	stateDir = filepath.Join(dir, "flexdev-state")
+	serverEnv.path = filepath.Join(stateDir, "env.json")
+	serverAccess.path = filepath.Join(stateDir, "access.json")
+	auditLog.path = filepath.Join(stateDir, "audit.log")
+	slots[flexdev.DefaultSlot].dir = packageDir
+	return nil
+}
+
 func main() {
 	http.HandleFunc("/", proxyHandler)
 
-	http.HandleFunc("/_flexdev/build/", adminHandler)
+	http.HandleFunc("/_flexdev/", adminHandler)
+	http.HandleFunc("/_flexdev/state", stateHandler)
+	http.HandleFunc("/_flexdev/reload", reloadHandler)
+	adminMux.HandleFunc("/_flexdev/build/limits", uploadLimitsHandler)
 	adminMux.HandleFunc("/_flexdev/build/create", createBuildHandler)
 	adminMux.HandleFunc("/_flexdev/build/put", putFileHandler)
 	adminMux.HandleFunc("/_flexdev/build/start", startBuildHandler)
 	adminMux.HandleFunc("/_flexdev/build/status", statusHandler)
+	adminMux.HandleFunc("/_flexdev/logs", logsHandler)
+	adminMux.HandleFunc("/_flexdev/app/start", startAppHandler)
+	adminMux.HandleFunc("/_flexdev/app/stop", stopAppHandler)
+	adminMux.HandleFunc("/_flexdev/app/restart", restartAppHandler)
+	adminMux.HandleFunc("/_flexdev/env/list", envListHandler)
+	adminMux.HandleFunc("/_flexdev/env/set", envSetHandler)
+	adminMux.HandleFunc("/_flexdev/env/unset", envUnsetHandler)
+	adminMux.HandleFunc("/_flexdev/requests", requestsHandler)
+	adminMux.HandleFunc("/_flexdev/requests/replay", replayHandler)
+	adminMux.HandleFunc("/_flexdev/shadow/start", shadowStartHandler)
+	adminMux.HandleFunc("/_flexdev/shadow/stop", shadowStopHandler)
+	adminMux.HandleFunc("/_flexdev/shadow/report", shadowReportHandler)
+	adminMux.HandleFunc("/_flexdev/metrics", metricsHandler)
+	adminMux.HandleFunc("/_flexdev/access/list", accessListHandler)
+	adminMux.HandleFunc("/_flexdev/access/grant", accessGrantHandler)
+	adminMux.HandleFunc("/_flexdev/access/revoke", accessRevokeHandler)
+	adminMux.HandleFunc("/_flexdev/history", historyHandler)
+
+	flag.Parse()
+	if *workDir != "" {
+		if err := setWorkDir(*workDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var err error
+	if auth, err = newAuthenticator(); err != nil {
+		log.Fatal(err)
+	}
+	if uploadLimits, err = newUploadLimits(); err != nil {
+		log.Fatal(err)
+	}
+	if uploadLimits.MaxUploads > 0 {
+		uploadSlots = make(chan struct{}, uploadLimits.MaxUploads)
+	}
+	tc, err := tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := auth.(mtlsAuth); ok && (tc == nil || tc.ClientCAs == nil) {
+		log.Fatal("mtls auth needs FLEXDEV_TLS_CERT, FLEXDEV_TLS_KEY and FLEXDEV_TLS_CLIENT_CA.")
+	}
+
+	if *devConfig != "" {
+		if _, ok := auth.(appEngineAuth); ok {
+			log.Fatal("-dev needs FLEXDEV_AUTH, as App Engine auth only works on App Engine.")
+		}
+		go devLoop(*devConfig)
+		go printLogs(slots[flexdev.DefaultSlot])
+	}
 
 	log.Print("Server running.")
 
-	appengine.Main()
+	// appengine.Main sends every request through the App Engine APIs, which
+	// only exist on App Engine.
+	if _, ok := auth.(appEngineAuth); ok && tc == nil {
+		appengine.Main()
+		return
+	}
+	if *addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		*addr = ":" + port
+	}
+	srv := &http.Server{Addr: *addr, TLSConfig: tc}
+	log.Printf("Listening on %s.", *addr)
+	go stopOnSignal()
+	if tc != nil {
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(srv.ListenAndServe())
+}
+
+// stopOnSignal stops the apps when the server is told to exit, so they
+// aren't left running without it.
+func stopOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	for _, s := range allSlots() {
+		s.mu.Lock()
+		if s.build != nil && s.build.State == flexdev.StateRunning {
+			if err := s.build.Stop(); err != nil {
+				log.Printf("Could not stop app in slot %s: %v", s.name, err)
+			}
+		}
+		s.mu.Unlock()
+	}
+	log.Printf("Stopped on %v.", sig)
+	os.Exit(0)
 }
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	buildMu.RLock()
-	defer buildMu.RUnlock()
-
-	if build == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintf(w, "No app to run. Use `flexdev deploy` to deploy the application code.")
+	s, r, err := routeSlot(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if build.State != flexdev.StateRunning {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintf(w, "state: %s\n", build.State)
-		fmt.Fprintf(w, "%s", build.output.String())
-		return
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	v := serveProxy(sw, r, s)
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	build := ""
+	if v.build != nil {
+		build = v.build.ID
+	}
+	proxyRequests.add(1, s.name, build, strconv.Itoa(sw.status))
+	proxyLatency.observe(time.Since(start).Seconds(), s.name, build)
+}
+
+// serveProxy serves r from slot s, and returns the view of the build it used.
+func serveProxy(w http.ResponseWriter, r *http.Request, s *slot) view {
+	v, changed := s.currentView()
+	if serveStatic(w, r, v) {
+		return v
+	}
+	v = hold(r, v, changed)
+
+	if !v.running() {
+		serveUnavailable(w, r, v)
+		return v
+	}
+	w.Header().Set("X-FlexDev", flexdev.Version)
+	if sh := s.currentShadow(); sh != nil && sh.sample(r) {
+		if body, ok := shadowBody(r); ok {
+			// Live reload would make HTML bodies differ.
+			capture(v, w, r, func(w http.ResponseWriter, r *http.Request) {
+				sh.mirror(w, r, body, v.build.redactor(), newProxy(v, false).ServeHTTP)
+			})
+			return v
+		}
 	}
+	capture(v, w, r, newProxy(v, true).ServeHTTP)
+	return v
+}
+
+// newProxy returns a proxy to the app in v.
+func newProxy(v view, liveReload bool) *httputil.ReverseProxy {
 	target := &url.URL{
 		Scheme: "http",
-		Host:   build.addr,
+		Host:   v.addr,
 	}
 
-	w.Header().Set("X-FlexDev", flexdev.Version)
-	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = v.transport
+	proxy.Director = v.build.config.Flexdev.Headers.director(proxy.Director)
+	if liveReload && v.build.config.Flexdev.LiveReload {
+		proxy.ModifyResponse = injectReload(v)
+	}
+	return proxy
 }
 
 func adminHandler(w http.ResponseWriter, r *http.Request) {
@@ -92,57 +242,57 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
+	if n := maxBodySize(r.URL.Path); n >= 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+	}
+	id, err := auth.authenticate(r)
+	if err == errMissingAuth {
 		Response{
 			Code:  http.StatusUnauthorized,
-			Error: errors.New("Missing auth token."),
+			Error: err,
 		}.WriteTo(w)
 		return
-	}
-
-	ctx := appengine.NewContext(r)
-	if err := checkAuth(ctx, auth); err != nil {
+	} else if err != nil && strings.Contains(err.Error(), errBodyTooLarge) {
+		Response{
+			Code:  http.StatusRequestEntityTooLarge,
+			Error: fmt.Errorf("Request body is larger than the limit of %s.", flexdev.HumanSize(maxBodySize(r.URL.Path))),
+		}.WriteTo(w)
+		return
+	} else if err != nil {
 		Response{
 			Code:  http.StatusForbidden,
 			Error: fmt.Errorf("Could not verify your auth: %v", err),
 		}.WriteTo(w)
 		return
 	}
-
-	adminMux.ServeHTTP(w, r)
-}
-
-func checkAuth(ctx context.Context, h string) error {
-	if os.Getenv("FLEXDEV_NOAUTH") != "" {
-		return nil
-	}
-
-	u, err := user.CurrentOAuth(ctx,
-		"https://www.googleapis.com/auth/cloud-platform",
-		"https://www.googleapis.com/auth/appengine.apis")
+	r, err = authorize(r, id)
 	if err != nil {
-		return err
-	}
-	if !u.Admin {
-		return errors.New("Must be an admin.")
+		Response{Code: http.StatusForbidden, Error: err}.WriteTo(w)
+		return
 	}
-	return nil
+
+	adminMux.ServeHTTP(w, r)
 }
 
 func createBuildHandler(w http.ResponseWriter, r *http.Request) {
-	buildMu.Lock()
-	defer buildMu.Unlock()
-
-	if build != nil && build.State == flexdev.StateRunning {
-		if err := build.Stop(); err != nil {
-			Response{Error: fmt.Errorf("Could not stop existing binary: %v", err)}.WriteTo(w)
-			return
-		}
+	s, err := slotParam(r, true)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
 
 	var buildReq flexdev.CreateBuildRequest
 	if err := json.NewDecoder(r.Body).Decode(&buildReq); err != nil {
+		if err.Error() == errBodyTooLarge {
+			Response{
+				Code:  http.StatusRequestEntityTooLarge,
+				Error: fmt.Errorf("Build req is larger than the limit of %s. Deploy fewer files.", flexdev.HumanSize(maxBodySize(r.URL.Path))),
+			}.WriteTo(w)
+			return
+		}
 		if err != io.EOF {
 			Response{Error: fmt.Errorf("Could not read build req: %v", err)}.WriteTo(w)
 			return
@@ -162,6 +312,26 @@ func createBuildHandler(w http.ResponseWriter, r *http.Request) {
 		}.WriteTo(w)
 		return
 	}
+	files, err := buildReq.Files.Clean()
+	if err != nil {
+		bad, _ := err.(flexdev.BadPaths)
+		Response{
+			Error:    fmt.Errorf("Could not accept dir list: %v", err),
+			Code:     http.StatusBadRequest,
+			BadPaths: bad,
+		}.WriteTo(w)
+		return
+	}
+
+	if err := uploadLimits.Check(files); err != nil {
+		bad, _ := err.(flexdev.BadPaths)
+		Response{
+			Error:    fmt.Errorf("Could not accept dir list: %v", err),
+			Code:     http.StatusRequestEntityTooLarge,
+			BadPaths: bad,
+		}.WriteTo(w)
+		return
+	}
 
 	var config config
 	if err := yaml.Unmarshal(buildReq.Config, &config); err != nil {
@@ -169,118 +339,367 @@ func createBuildHandler(w http.ResponseWriter, r *http.Request) {
 			Error: fmt.Errorf("Could not parse yaml config: %v", err),
 			Code:  http.StatusBadRequest,
 		}.WriteTo(w)
+		return
+	}
+	if err := config.parse(); err != nil {
+		Response{Error: err, Code: http.StatusBadRequest}.WriteTo(w)
+		return
+	}
+
+	// Only a deploy that's accepted takes the current app down.
+	if s.build != nil && s.build.State == flexdev.StateRunning {
+		if err := s.build.Stop(); err != nil {
+			Response{Error: fmt.Errorf("Could not stop existing binary: %v", err)}.WriteTo(w)
+			return
+		}
 	}
 
-	// Ensure packageDir exists.
-	if err := os.MkdirAll(packageDir, 0755); err != nil {
+	build, err := s.createBuild(files, &config)
+	if err != nil {
 		Response{Error: err}.WriteTo(w)
 		return
 	}
 
+	Response{
+		Message:     "Build created.",
+		Build:       build,
+		NeedFiles:   build.added,
+		UploadToken: build.uploadToken,
+	}.WriteTo(w)
+}
+
+// createBuild makes a new build of files in s, and removes what files only
+// the last build had. Those it doesn't have yet are in its added list. Must be
+// called with s.mu held.
+func (s *slot) createBuild(files flexdev.DirList, config *config) (*Build, error) {
+	// Ensure the slot's directory exists.
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	token, err := flexdev.NewUploadToken()
+	if err != nil {
+		return nil, fmt.Errorf("Could not create upload token: %v", err)
+	}
+
 	id := fmt.Sprintf("%d", time.Now().UnixNano())
-	build = &Build{}
+	build := &Build{}
 	build.ID = id
 	build.State = flexdev.StateCreated
-	build.dir = packageDir
-	build.clientFiles = buildReq.Files
-	build.config = &config
-
-	log.Printf("Created build %s", build.ID)
+	build.slot = s
+	build.dir = s.dir
+	build.clientFiles = files
+	build.created = time.Now()
+	build.config = config
+	build.uploadToken = token
+	build.treeHash = files.TreeHash()
+	build.logs = flexdev.NewLogBuffer(config.Flexdev.Logs.MaxLines, int(config.Flexdev.Logs.maxSize))
+	s.build = build
+	s.addBuild(build)
+
+	log.Printf("Created build %s in slot %s", build.ID, s.name)
 
 	need, remove, err := build.filesNeeded()
 	if err != nil {
-		Response{Error: fmt.Errorf("Could not get needed files: %v", err)}.WriteTo(w)
-		return
+		return nil, fmt.Errorf("Could not get needed files: %v", err)
 	}
+	build.manifest = flexdev.NewManifest(files, need)
+	build.added = need
 	for _, f := range remove {
-		if f == "_gopath/pkg" {
+		p, err := flexdev.JoinPath(build.dir, f)
+		if err != nil {
+			// The server's own files, or paths that aren't safe to remove.
 			continue
 		}
 		log.Printf("Removing %s", f)
-		if err := os.RemoveAll(filepath.Join(build.dir, f)); err != nil {
-			Response{Error: err}.WriteTo(w)
-			return
+		if err := os.RemoveAll(p); err != nil {
+			return nil, err
 		}
+		build.removed = append(build.removed, f)
 	}
-
-	Response{
-		Message:   "Build created.",
-		Build:     build,
-		NeedFiles: need,
-	}.WriteTo(w)
+	return build, nil
 }
 
 func putFileHandler(w http.ResponseWriter, r *http.Request) {
-	buildMu.RLock()
-	defer buildMu.RUnlock()
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	buildID := r.FormValue("id")
-	dest := r.FormValue("filename")
+	filename := r.FormValue("filename")
 	hash := r.FormValue("sha1")
 
 	if buildID == "" {
 		Response{Code: http.StatusBadRequest, Error: errors.New("Missing build ID.")}.WriteTo(w)
 		return
 	}
-	if buildID != build.ID {
+	build := s.build
+	if build == nil || buildID != build.ID {
 		Response{Code: http.StatusBadRequest, Error: errors.New("Build ID does not match.")}.WriteTo(w)
 		return
 	}
-	if dest == "" {
+	if err := flexdev.CheckUploadToken(r.Header.Get(flexdev.UploadTokenHeader), build.uploadToken); err != nil {
+		Response{Code: http.StatusForbidden, Error: fmt.Errorf("Could not accept file: %v.", err)}.WriteTo(w)
+		return
+	}
+	if build.State != flexdev.StateCreated {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Build is %s and no longer accepts files.", build.State)}.WriteTo(w)
+		return
+	}
+	if filename == "" {
 		Response{Code: http.StatusBadRequest, Error: errors.New("Missing destination filename.")}.WriteTo(w)
 		return
 	}
+	dest, err := flexdev.CleanPath(filename)
+	if err != nil {
+		Response{
+			Code:     http.StatusBadRequest,
+			Error:    fmt.Errorf("Bad destination filename %q: %v", filename, err),
+			BadPaths: flexdev.BadPaths{{Path: filename, Reason: err.Error()}},
+		}.WriteTo(w)
+		return
+	}
+	path, err := flexdev.JoinPath(build.dir, dest)
+	if err != nil {
+		Response{
+			Code:     http.StatusBadRequest,
+			Error:    fmt.Errorf("Bad destination filename %q: %v", filename, err),
+			BadPaths: flexdev.BadPaths{{Path: filename, Reason: err.Error()}},
+		}.WriteTo(w)
+		return
+	}
 	if hash == "" {
 		Response{Code: http.StatusBadRequest, Error: errors.New("Missing hash.")}.WriteTo(w)
 		return
 	}
-	b, err := ioutil.ReadAll(r.Body)
+	size, err := build.manifest.Check(dest, hash)
 	if err != nil {
-		Response{Error: err}.WriteTo(w)
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Could not accept %s: %v.", dest, err)}.WriteTo(w)
 		return
 	}
-	if fmt.Sprintf("%x", sha1.Sum(b)) != hash {
-		Response{Code: http.StatusBadRequest, Error: errors.New("sum did not match")}.WriteTo(w)
+	if !acquireUpload() {
+		Response{
+			Code:  http.StatusTooManyRequests,
+			Error: fmt.Errorf("Could not accept %s: the server is already receiving its limit of %d files at once. Try again later.", dest, uploadLimits.MaxUploads),
+		}.WriteTo(w)
 		return
 	}
+	defer releaseUpload()
 
-	if err := os.MkdirAll(filepath.Dir(filepath.Join(build.dir, dest)), 0755); err != nil {
-		Response{Error: fmt.Errorf("Could not mkdir -p %s: %v", dest, err)}.WriteTo(w)
+	log.Print("Writing to ", path)
+	n, err := writeUpload(path, r.Body, size, hash)
+	switch {
+	case err == errTooLarge:
+		Response{
+			Code:  http.StatusRequestEntityTooLarge,
+			Error: fmt.Errorf("Could not accept %s: larger than the %s declared for it.", dest, flexdev.HumanSize(size)),
+		}.WriteTo(w)
 		return
-	}
-
-	log.Print("Writing to ", filepath.Join(build.dir, dest))
-	if err := ioutil.WriteFile(filepath.Join(build.dir, dest), b, 0755); err != nil {
+	case err != nil && err.Error() == errBodyTooLarge:
+		Response{
+			Code:  http.StatusRequestEntityTooLarge,
+			Error: fmt.Errorf("Could not accept %s: larger than the limit of %s per file.", dest, flexdev.HumanSize(uploadLimits.MaxFileSize)),
+		}.WriteTo(w)
+		return
+	case err == errSumMismatch:
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Could not accept %s: sum did not match.", dest)}.WriteTo(w)
+		return
+	case err != nil:
 		Response{Error: fmt.Errorf("Could not write file to %s: %v", dest, err)}.WriteTo(w)
 		return
 	}
+	build.manifest.Received(dest)
+	uploadBytes.add(float64(n), s.name)
+	uploadFiles.add(1, s.name)
 
 	Response{Message: fmt.Sprintf("Wrote %s", dest)}.WriteTo(w)
 }
 
 func startBuildHandler(w http.ResponseWriter, r *http.Request) {
-	buildMu.Lock()
-	defer buildMu.Unlock()
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
 
-	if err := build.GoBuild(); err != nil {
+	build := s.build
+	if build == nil {
+		Response{Code: http.StatusBadRequest, Error: errors.New("No build. Use `flexdev deploy` first.")}.WriteTo(w)
+		return
+	}
+	if err := flexdev.CheckUploadToken(r.Header.Get(flexdev.UploadTokenHeader), build.uploadToken); err != nil {
+		Response{Code: http.StatusForbidden, Error: fmt.Errorf("Could not start build %s: %v.", build.ID, err)}.WriteTo(w)
+		return
+	}
+	if missing := build.manifest.Missing(); len(missing) > 0 {
 		Response{
-			Message: build.output.String(),
+			Code:      http.StatusBadRequest,
+			Error:     fmt.Errorf("Could not start build %s: %d files not uploaded.", build.ID, len(missing)),
+			NeedFiles: missing,
+		}.WriteTo(w)
+		return
+	}
+	e := flexdev.AuditEvent{
+		Action:   "deploy",
+		Slot:     s.name,
+		Build:    build.ID,
+		TreeHash: build.treeHash,
+		Added:    build.added,
+		Removed:  build.removed,
+		Phases:   map[string]float64{},
+	}
+	defer func() { audit(r, e) }()
+	if build.State == flexdev.StateCreated {
+		e.Phases["upload"] = time.Since(build.created).Seconds()
+		deployPhase.observe(e.Phases["upload"], s.name, "upload")
+	}
+	start := time.Now()
+	err = build.GoBuild()
+	e.Phases["build"] = time.Since(start).Seconds()
+	if err != nil {
+		e.Outcome = fmt.Sprintf("Build failed: %v", err)
+		Response{
+			Message: build.redactor().Redact(build.logs.String(flexdev.LogQuery{Streams: []flexdev.Stream{flexdev.StreamBuild}})),
 			Error:   fmt.Errorf("Build failed: %v", err),
 		}.WriteTo(w)
 		return
 	}
-	if err := build.Start(); err != nil {
+	start = time.Now()
+	err = build.Start()
+	e.Phases["start"] = time.Since(start).Seconds()
+	if err != nil {
+		e.Outcome = fmt.Sprintf("Could not run binary: %v", err)
 		Response{Error: fmt.Errorf("Could not run binary: %v", err)}.WriteTo(w)
 		return
 	}
 	Response{Message: "App is running."}.WriteTo(w)
 }
 
+// startAppHandler runs the current build's binary again, without rebuilding.
+func startAppHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
+
+	if err := s.checkStartable(); err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	if s.build.State == flexdev.StateRunning {
+		Response{Code: http.StatusBadRequest, Error: errors.New("App is already running.")}.WriteTo(w)
+		return
+	}
+	err = s.build.Start()
+	audit(r, flexdev.AuditEvent{Action: "app.start", Slot: s.name, Build: s.build.ID, Outcome: outcome(err)})
+	if err != nil {
+		Response{Error: fmt.Errorf("Could not run binary: %v", err)}.WriteTo(w)
+		return
+	}
+	Response{Message: "App is running."}.WriteTo(w)
+}
+
+func stopAppHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
+
+	if s.build == nil || s.build.State != flexdev.StateRunning {
+		Response{Code: http.StatusBadRequest, Error: errors.New("App is not running.")}.WriteTo(w)
+		return
+	}
+	err = s.build.Stop()
+	audit(r, flexdev.AuditEvent{Action: "app.stop", Slot: s.name, Build: s.build.ID, Outcome: outcome(err)})
+	if err != nil {
+		Response{Error: fmt.Errorf("Could not stop binary: %v", err)}.WriteTo(w)
+		return
+	}
+	Response{Message: "App stopped."}.WriteTo(w)
+}
+
+func restartAppHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.publish()
+
+	if err := s.checkStartable(); err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	e := flexdev.AuditEvent{Action: "app.restart", Slot: s.name, Build: s.build.ID}
+	defer func() { audit(r, e) }()
+	if s.build.State == flexdev.StateRunning {
+		if err := s.build.Stop(); err != nil {
+			e.Outcome = fmt.Sprintf("Could not stop binary: %v", err)
+			Response{Error: fmt.Errorf("Could not stop binary: %v", err)}.WriteTo(w)
+			return
+		}
+	}
+	if err := s.build.Start(); err != nil {
+		e.Outcome = fmt.Sprintf("Could not run binary: %v", err)
+		Response{Error: fmt.Errorf("Could not run binary: %v", err)}.WriteTo(w)
+		return
+	}
+	appRestarts.add(1, s.name)
+	Response{Message: "App restarted."}.WriteTo(w)
+}
+
+// checkStartable returns an error unless the slot's current build has a
+// binary. Must be called with s.mu held.
+func (s *slot) checkStartable() error {
+	if s.build == nil {
+		return errors.New("No build. Use `flexdev deploy` first.")
+	}
+	switch s.build.State {
+	case flexdev.StateBuilt, flexdev.StateRunning, flexdev.StateStopped:
+		return nil
+	}
+	return fmt.Errorf("Build is %s. Use `flexdev deploy` to build it.", s.build.State)
+}
+
 func statusHandler(w http.ResponseWriter, r *http.Request) {
-	buildMu.Lock()
-	defer buildMu.Unlock()
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusNotFound, Error: err}.WriteTo(w)
+		return
+	}
 
 	buf := &bytes.Buffer{}
+	for _, o := range allSlots() {
+		v, _ := o.currentView()
+		if v.build == nil {
+			fmt.Fprintf(buf, "slot %s: no build\n", o.name)
+			continue
+		}
+		fmt.Fprintf(buf, "slot %s: build %s (%s)\n", o.name, v.build.ID, v.state)
+	}
+	fmt.Fprintln(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	build := s.build
 	if build == nil {
 		fmt.Fprintln(buf, "build=nil")
 		Response{Message: buf.String()}.WriteTo(w)
@@ -289,18 +708,32 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(buf, build.ID)
 	fmt.Fprintln(buf, build.State)
 	fmt.Fprintln(buf, build.addr)
-	fmt.Fprintln(buf, build.config)
-	fmt.Fprintf(buf, "%s\n", build.output.Bytes())
+	fmt.Fprintln(buf, build.redactedConfig())
+	fmt.Fprintln(buf, build.limitReport())
+	for _, b := range s.builds {
+		if b != build {
+			fmt.Fprintf(buf, "previous build: %s (%s)\n", b.ID, b.State)
+		}
+	}
+	fmt.Fprintf(buf, "%s\n", build.logs.String(flexdev.LogQuery{}))
 
-	Response{Message: buf.String()}.WriteTo(w)
+	Response{Message: build.redactor().Redact(buf.String())}.WriteTo(w)
 }
 
 type Response struct {
-	Code      int      `json:"code,omitempty"`
-	Error     error    `json:"-"`
-	Build     *Build   `json:"build,omitempty"`
-	NeedFiles []string `json:"need_files,omitempty"`
-	Message   string   `json:"message,omitempty"`
+	Code         int                       `json:"code,omitempty"`
+	Error        error                     `json:"-"`
+	Build        *Build                    `json:"build,omitempty"`
+	NeedFiles    []string                  `json:"need_files,omitempty"`
+	BadPaths     flexdev.BadPaths          `json:"bad_paths,omitempty"`
+	UploadToken  string                    `json:"upload_token,omitempty"`
+	Env          []flexdev.EnvVar          `json:"env,omitempty"`
+	Requests     []flexdev.CapturedRequest `json:"requests,omitempty"`
+	Shadow       *flexdev.ShadowReport     `json:"shadow,omitempty"`
+	Access       []flexdev.Grant           `json:"access,omitempty"`
+	History      []flexdev.AuditEvent      `json:"history,omitempty"`
+	UploadLimits *flexdev.UploadLimits     `json:"upload_limits,omitempty"`
+	Message      string                    `json:"message,omitempty"`
 
 	// Used for serialization.
 	ErrorJSON string `json:"error,omitempty"`
@@ -0,0 +1,270 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func TestMain(m *testing.M) {
+	// Keep builds and state out of the real work dir.
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := setWorkDir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testConfig parses an uploaded config.
+func testConfig(t *testing.T, y string) *config {
+	var c config
+	if err := yaml.Unmarshal([]byte(y), &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.parse(); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+// testSlot adds a slot whose build is running app, and returns it with a
+// function to remove it.
+func testSlot(t *testing.T, name string, app *httptest.Server, c *config) (*slot, func()) {
+	u, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSlot(name)
+	s.build = &Build{
+		slot:   s,
+		addr:   u.Host,
+		config: c,
+		logs:   flexdev.NewLogBuffer(0, 0),
+	}
+	s.build.ID = "1"
+	s.build.State = flexdev.StateRunning
+	s.publish()
+
+	slotsMu.Lock()
+	slots[name] = s
+	slotsMu.Unlock()
+	return s, func() {
+		slotsMu.Lock()
+		delete(slots, name)
+		slotsMu.Unlock()
+	}
+}
+
+// upgradeApp answers upgrade requests by echoing lines back.
+func upgradeApp() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "want upgrade", http.StatusBadRequest)
+			return
+		}
+		c, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		line, _ := rw.ReadString('\n')
+		fmt.Fprint(rw, line)
+		rw.Flush()
+	}))
+}
+
+// upgrade sends an upgrade request to front and checks that the connection
+// then echoes.
+func upgrade(t *testing.T, front *httptest.Server, slot string) {
+	c, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: app\r\nConnection: Upgrade\r\nUpgrade: echo\r\n%s: %s\r\n\r\n", flexdev.SlotHeader, slot)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("status %d (%s), want 101", resp.StatusCode, b)
+	}
+	fmt.Fprint(c, "ping\n")
+	if got, _ := br.ReadString('\n'); got != "ping\n" {
+		t.Errorf("echo = %q, want %q", got, "ping\n")
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	app := upgradeApp()
+	defer app.Close()
+	front := httptest.NewServer(http.HandlerFunc(proxyHandler))
+	defer front.Close()
+
+	for name, y := range map[string]string{
+		"plain":   "runtime: go",
+		"capture": "runtime: go\nflexdev:\n  capture_requests:\n    max_requests: 10",
+	} {
+		_, done := testSlot(t, "up-"+name, app, testConfig(t, y))
+		upgrade(t, front, "up-"+name)
+		done()
+	}
+}
+
+func TestShadowWriterUpgrade(t *testing.T) {
+	app := upgradeApp()
+	defer app.Close()
+	s, done := testSlot(t, "up-shadow", app, testConfig(t, "runtime: go"))
+	defer done()
+	v, _ := s.currentView()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newProxy(v, false).ServeHTTP(newShadowWriter(w, nil), r)
+	}))
+	defer front.Close()
+	upgrade(t, front, "up-shadow")
+}
+
+// createBuild sends a create request for files to slot, with the body limit
+// adminHandler would apply.
+func createBuild(t *testing.T, slot string, files flexdev.DirList) *httptest.ResponseRecorder {
+	body, err := json.Marshal(flexdev.CreateBuildRequest{Config: []byte("runtime: go"), Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/_flexdev/build/create?slot="+slot, bytes.NewReader(body))
+	if n := maxBodySize(r.URL.Path); n >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+	}
+	createBuildHandler(w, r)
+	return w
+}
+
+func TestPutFileUploadToken(t *testing.T) {
+	files := flexdev.DirList{{Path: "a.txt", SHA1: "c22b5f9178342609428d6f51b2c5af4c0bde6a42", Size: 2}}
+	w := createBuild(t, "upload", files)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	defer func() {
+		slotsMu.Lock()
+		delete(slots, "upload")
+		slotsMu.Unlock()
+	}()
+	var resp struct {
+		UploadToken string `json:"upload_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.UploadToken == "" {
+		t.Fatalf("create response %s has no upload token (%v)", w.Body, err)
+	}
+	s, err := getSlot("upload", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(token string) *httptest.ResponseRecorder {
+		q := url.Values{"slot": {"upload"}, "id": {s.build.ID}, "filename": {"a.txt"}, "sha1": {files[0].SHA1}}
+		r := httptest.NewRequest("POST", "/_flexdev/build/put?"+q.Encode(), strings.NewReader("hi"))
+		if token != "" {
+			r.Header.Set(flexdev.UploadTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		putFileHandler(w, r)
+		return w
+	}
+	for _, token := range []string{"", "wrong", resp.UploadToken + "x"} {
+		if w := put(token); w.Code != http.StatusForbidden {
+			t.Errorf("put with token %q: %d %s, want 403", token, w.Code, w.Body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written without the upload token: %v", err)
+	}
+	if w := put(resp.UploadToken); w.Code != http.StatusOK {
+		t.Fatalf("put with token: %d %s", w.Code, w.Body)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(s.dir, "a.txt")); err != nil || string(b) != "hi" {
+		t.Errorf("a.txt = %q, %v; want %q", b, err, "hi")
+	}
+}
+
+func TestRejectedDeployKeepsApp(t *testing.T) {
+	app := httptest.NewServer(http.NotFoundHandler())
+	defer app.Close()
+
+	for name, files := range map[string]flexdev.DirList{
+		"absolute": {{Path: "/etc/passwd", SHA1: "x", Size: 1}},
+		"dotdot":   {{Path: "../a.txt", SHA1: "x", Size: 1}},
+		"reserved": {{Path: "flexdev-server", SHA1: "x", Size: 1}},
+	} {
+		s, done := testSlot(t, "rejected", app, testConfig(t, "runtime: go"))
+		s.build.cmd = new(exec.Cmd)
+		w := createBuild(t, "rejected", files)
+		if w.Code < 400 || w.Code >= 500 {
+			t.Errorf("%s: %d %s, want a 4xx", name, w.Code, w.Body)
+		}
+		if s.build.State != flexdev.StateRunning {
+			t.Errorf("%s: rejected deploy left the app %s", name, s.build.State)
+		}
+		done()
+	}
+}
+
+func TestOversizeDeployKeepsApp(t *testing.T) {
+	app := httptest.NewServer(http.NotFoundHandler())
+	defer app.Close()
+	old := uploadLimits
+	defer func() { uploadLimits = old }()
+	uploadLimits = flexdev.UploadLimits{MaxFiles: 2, MaxBuildSize: 10}
+
+	var many flexdev.DirList
+	for i := 0; i < 20000; i++ {
+		many = append(many, flexdev.DirEntry{Path: fmt.Sprintf("static/file%05d.txt", i), SHA1: "x"})
+	}
+	for name, files := range map[string]flexdev.DirList{
+		"body":  many,
+		"files": many[:3],
+		"bytes": {{Path: "a.txt", SHA1: "x", Size: 11}},
+	} {
+		s, done := testSlot(t, "oversize", app, testConfig(t, "runtime: go"))
+		s.build.cmd = new(exec.Cmd)
+		w := createBuild(t, "oversize", files)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: %d %.200s, want 413", name, w.Code, w.Body)
+		}
+		if s.build.State != flexdev.StateRunning {
+			t.Errorf("%s: rejected deploy left the app %s", name, s.build.State)
+		}
+		done()
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// limits restrict the resources available to the app, so that a leaking app
+// can't take the flexdev server down with it.
+type limits struct {
+	Memory    string  `yaml:"memory"`     // e.g. "512M".
+	CPU       float64 `yaml:"cpu"`        // Number of CPUs, e.g. 0.5.
+	OpenFiles uint64  `yaml:"open_files"` // RLIMIT_NOFILE.
+	Processes uint64  `yaml:"processes"`  // RLIMIT_NPROC and pids.max.
+
+	memory int64
+}
+
+func (l *limits) parse() error {
+	l.memory = 0
+	if l.Memory != "" {
+		n, err := flexdev.ParseSize(l.Memory)
+		if err != nil {
+			return fmt.Errorf("Bad memory limit: %v", err)
+		}
+		l.memory = n
+	}
+	if l.CPU < 0 {
+		return fmt.Errorf("Bad cpu limit: %v", l.CPU)
+	}
+	return nil
+}
+
+func (l limits) empty() bool {
+	return l.memory == 0 && l.CPU == 0 && l.OpenFiles == 0 && l.Processes == 0
+}
+
+func (l limits) String() string {
+	if l.empty() {
+		return "none"
+	}
+	buf := &bytes.Buffer{}
+	if l.memory != 0 {
+		fmt.Fprintf(buf, "memory=%s ", flexdev.FormatSize(l.memory))
+	}
+	if l.CPU != 0 {
+		fmt.Fprintf(buf, "cpu=%g ", l.CPU)
+	}
+	if l.OpenFiles != 0 {
+		fmt.Fprintf(buf, "open_files=%d ", l.OpenFiles)
+	}
+	if l.Processes != 0 {
+		fmt.Fprintf(buf, "processes=%d ", l.Processes)
+	}
+	return string(bytes.TrimSpace(buf.Bytes()))
+}
+
+// limitReport describes the configured limits and how often the app ran into
+// them, for the status output.
+func (b *Build) limitReport() string {
+	l := b.config.Flexdev.Limits
+	s := "limits: " + l.String()
+	if b.cgroup != "" {
+		s += " (cgroup " + b.cgroup + ")"
+		if hits := cgroupHits(b.cgroup); hits != "" {
+			s += "\nlimit hits: " + hits
+		}
+	}
+	if b.exit != "" {
+		s += "\n" + b.exit
+	}
+	return s
+}
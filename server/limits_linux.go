@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var cgroupRoot = "/sys/fs/cgroup"
+
+// prepareLimits sets up the limits the app will run under, and returns the
+// cgroup it will run in, if any, and shell commands that apply them to the
+// shell they run in. The shell then execs the app, so the limits hold from
+// its first instruction. Memory, CPU and process limits are enforced with a
+// cgroup v2 subtree named name when possible, otherwise with rlimits and
+// priority.
+func prepareLimits(name string, l limits) (cgroup, script string, err error) {
+	// Whatever else happens, the OOM killer should pick the app over us.
+	sh := []string{"set -e", "(echo 1000 >/proc/$$/oom_score_adj) 2>/dev/null || true"}
+	if !l.empty() {
+		var more []string
+		cgroup, more = limitCommands(name, l)
+		sh = append(sh, more...)
+	}
+	return cgroup, strings.Join(sh, "; ") + "; ", nil
+}
+
+// limitCommands returns the cgroup for l, if one can be used, and the
+// commands that apply the rest of l.
+func limitCommands(name string, l limits) (cgroup string, sh []string) {
+	if l.OpenFiles != 0 {
+		sh = append(sh, fmt.Sprintf("ulimit -n %d", l.OpenFiles))
+	}
+	if l.Processes != 0 {
+		// dash calls RLIMIT_NPROC -p, bash -u.
+		sh = append(sh, fmt.Sprintf("{ ulimit -p %[1]d 2>/dev/null || ulimit -u %[1]d; }", l.Processes))
+	}
+
+	cgroup, err := makeCgroup(name, l)
+	if err == nil {
+		return cgroup, append(sh, "echo $$ >"+shellQuote(filepath.Join(cgroup, "cgroup.procs")))
+	}
+	log.Printf("Could not use a cgroup for the app, falling back to rlimits: %v", err)
+
+	if l.memory != 0 {
+		// Not RLIMIT_AS: the Go runtime reserves far more address space than
+		// it uses, and fails to start under a tight limit.
+		sh = append(sh, fmt.Sprintf("ulimit -d %d", (l.memory+1023)/1024))
+	}
+	if l.CPU != 0 && l.CPU < 1 {
+		// Without a cgroup, the best we can do is make the app yield to us,
+		// if the host has renice.
+		sh = append(sh, "renice -n 10 -p $$ >/dev/null || true")
+	}
+	return "", sh
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// makeCgroup creates a cgroup named name next to the server's own, and
+// applies l to it.
+func makeCgroup(name string, l limits) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", errors.New("cgroup v2 is not mounted")
+	}
+	self, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(cgroupRoot, self)
+	leaf := filepath.Join(parent, "flexdev-server")
+	if filepath.Base(parent) == "flexdev-server" {
+		// We moved ourselves on a previous start.
+		parent, leaf = filepath.Dir(parent), parent
+	} else {
+		// Only leaf cgroups may hold processes once controllers are
+		// delegated, so the server needs a leaf of its own.
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if err := writeCgroup(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", err
+		}
+	}
+	for _, c := range []string{"+memory", "+cpu", "+pids"} {
+		if err := writeCgroup(parent, "cgroup.subtree_control", c); err != nil {
+			return "", err
+		}
+	}
+
+	app := filepath.Join(parent, name)
+	// Left over from the previous run of the app. Fails if something is
+	// still running in it, in which case it's reused.
+	os.Remove(app)
+	if err := os.Mkdir(app, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if l.memory != 0 {
+		if err := writeCgroup(app, "memory.max", strconv.FormatInt(l.memory, 10)); err != nil {
+			return "", err
+		}
+	}
+	if l.CPU != 0 {
+		const period = 100000
+		if err := writeCgroup(app, "cpu.max", fmt.Sprintf("%d %d", int64(l.CPU*period), period)); err != nil {
+			return "", err
+		}
+	}
+	if l.Processes != 0 {
+		if err := writeCgroup(app, "pids.max", strconv.FormatUint(l.Processes, 10)); err != nil {
+			return "", err
+		}
+	}
+	return app, nil
+}
+
+func ownCgroup() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+func writeCgroup(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("Could not write %q to %s: %v", value, filepath.Join(dir, file), err)
+	}
+	return nil
+}
+
+// cgroupHits summarizes how often the app in cgroup hit its limits.
+func cgroupHits(cgroup string) string {
+	var hits []string
+	add := func(file, key, name string) {
+		b, err := ioutil.ReadFile(filepath.Join(cgroup, file))
+		if err != nil {
+			return
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			f := strings.Fields(s.Text())
+			if len(f) == 2 && f[0] == key && f[1] != "0" {
+				hits = append(hits, name+"="+f[1])
+			}
+		}
+	}
+	add("memory.events", "max", "memory")
+	add("memory.events", "oom_kill", "oom_kill")
+	add("cpu.stat", "nr_throttled", "cpu_throttled")
+	add("pids.events", "max", "processes")
+	return strings.Join(hits, " ")
+}
+
+// processMemory returns the memory usage of cgroup, or if there is none, the
+// resident set size of pid.
+func processMemory(pid int, cgroup string) (int64, bool) {
+	if cgroup != "" {
+		b, err := ioutil.ReadFile(filepath.Join(cgroup, "memory.current"))
+		if err == nil {
+			n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+			return n, err == nil
+		}
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, false
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 3 && f[0] == "VmRSS:" && f[2] == "kB" {
+			n, err := strconv.ParseInt(f[1], 10, 64)
+			return n << 10, err == nil
+		}
+	}
+	return 0, false
+}
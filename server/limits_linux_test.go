@@ -0,0 +1,62 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLimitScriptRlimits(t *testing.T) {
+	// No cgroups here, so that the test process stays where it is.
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := cgroupRoot
+	cgroupRoot = dir
+	defer func() { cgroupRoot = old }()
+
+	l := limits{Memory: "64M", CPU: 0.5, OpenFiles: 100, Processes: 5000}
+	if err := l.parse(); err != nil {
+		t.Fatal(err)
+	}
+	cgroup, script, err := prepareLimits("test", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cgroup != "" {
+		t.Errorf("cgroup = %q without cgroups", cgroup)
+	}
+
+	// The limits are in place by the time the shell execs.
+	out, err := exec.Command("/bin/sh", "-c", script+`exec "$0" /proc/self/limits`, "cat").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for _, want := range []string{
+		"Max open files            100                  100",
+		"Max processes             5000                 5000",
+		"Max data size             67108864             67108864",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("limits don't have %q:\n%s", want, out)
+		}
+	}
+	if out, err := exec.Command("/bin/sh", "-c", script+`exec "$0"`, "nice").CombinedOutput(); err != nil || strings.TrimSpace(string(out)) == "0" {
+		t.Errorf("nice = %q, %v; want it lowered", out, err)
+	}
+
+	// The app still starts on hosts without renice.
+	cmd := exec.Command("/bin/sh", "-c", script+"echo started")
+	cmd.Env = []string{"PATH=" + dir}
+	if out, err := cmd.CombinedOutput(); err != nil || !strings.Contains(string(out), "started") {
+		t.Errorf("without renice: %q, %v; want the app started", out, err)
+	}
+}
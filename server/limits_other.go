@@ -0,0 +1,25 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func prepareLimits(name string, l limits) (cgroup, script string, err error) {
+	if l.empty() {
+		return "", "", nil
+	}
+	return "", "", errors.New("Resource limits are only supported on Linux.")
+}
+
+func cgroupHits(cgroup string) string {
+	return ""
+}
+
+func processMemory(pid int, cgroup string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// logsHandler streams log lines as newline-delimited JSON. With follow set, it
+// keeps streaming new lines until the client goes away. When following the
+// current build of a slot, it moves on to the slot's next build once one is
+// created.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := logQuery(r)
+	if err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	follow := r.FormValue("follow") != ""
+	id := r.FormValue("build")
+
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusNotFound, Error: err}.WriteTo(w)
+		return
+	}
+	// Builds hold s.mu, and their output is what's most worth following.
+	v, _ := s.currentView()
+	b := v.findBuild(id)
+	if b == nil {
+		if id == "" {
+			Response{Code: http.StatusNotFound, Error: errors.New("No build yet.")}.WriteTo(w)
+			return
+		}
+		Response{Code: http.StatusNotFound, Error: fmt.Errorf("No build %s. It may have expired.", id)}.WriteTo(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", flexdev.LogContentType)
+	enc := json.NewEncoder(w)
+	red := b.redactor()
+	flusher, _ := w.(http.Flusher)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		lines, changed := b.logs.Wait(q)
+		for _, l := range lines {
+			l.Text = red.Redact(l.Text)
+			if err := enc.Encode(l); err != nil {
+				return
+			}
+			q.AfterSeq = l.Seq
+		}
+		if !follow {
+			return
+		}
+		// Only the first batch is limited.
+		q.Limit = 0
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+			if id != "" {
+				continue
+			}
+			if v, _ := s.currentView(); v.build != nil && v.build != b {
+				b = v.build
+				red = b.redactor()
+				q.AfterSeq = 0
+			}
+		}
+	}
+}
+
+func logQuery(r *http.Request) (flexdev.LogQuery, error) {
+	var q flexdev.LogQuery
+	if s := r.FormValue("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return q, fmt.Errorf("Bad since: %v", err)
+		}
+		q.Since = t
+	}
+	if s := r.FormValue("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("Bad line count %q.", s)
+		}
+		q.Limit = n
+	}
+	if s := r.FormValue("stream"); s != "" {
+		for _, name := range strings.Split(s, ",") {
+			stream, err := flexdev.ParseStream(name)
+			if err != nil {
+				return q, err
+			}
+			q.Streams = append(q.Streams, stream)
+		}
+	}
+	return q, nil
+}
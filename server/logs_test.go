@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func TestLogsDuringBuild(t *testing.T) {
+	app := httptest.NewServer(http.NotFoundHandler())
+	defer app.Close()
+	s, done := testSlot(t, "logs-busy", app, testConfig(t, "runtime: go"))
+	defer done()
+	s.builds = []*Build{s.build}
+	s.publish()
+	logs := s.build.logs
+	logs.Add(flexdev.StreamBuild, "compiling")
+
+	front := httptest.NewServer(http.HandlerFunc(logsHandler))
+	defer front.Close()
+	defer front.CloseClientConnections()
+
+	// A build holds the slot for as long as it takes.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := make(chan string)
+	go func() {
+		resp, err := http.Get(front.URL + "/_flexdev/logs?slot=logs-busy&follow=1")
+		if err != nil {
+			close(lines)
+			return
+		}
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			var l flexdev.LogLine
+			if json.Unmarshal(sc.Bytes(), &l) == nil {
+				lines <- l.Text
+			}
+		}
+		close(lines)
+	}()
+
+	next := func() string {
+		select {
+		case l := <-lines:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("no log line while the build held the slot")
+			return ""
+		}
+	}
+	if l := next(); l != "compiling" {
+		t.Errorf("first line = %q, want compiling", l)
+	}
+	// Let the follow loop tick while the build is still going.
+	time.Sleep(1500 * time.Millisecond)
+	logs.Add(flexdev.StreamBuild, "linking")
+	if l := next(); l != "linking" {
+		t.Errorf("next line = %q, want linking", l)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	phaseBuckets   = []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+	proxyRequests = newMetric("flexdev_proxy_requests_total", "counter", "Requests through the proxy.", nil, "slot", "build", "code")
+	proxyLatency  = newMetric("flexdev_proxy_request_duration_seconds", "histogram", "Time to serve requests through the proxy, including time held.", latencyBuckets, "slot", "build")
+	deployPhase   = newMetric("flexdev_deploy_phase_duration_seconds", "histogram", "Time spent in each phase of a deploy: upload, build and start.", phaseBuckets, "slot", "phase")
+	uploadBytes   = newMetric("flexdev_upload_bytes_total", "counter", "Bytes of files received for builds.", nil, "slot")
+	uploadFiles   = newMetric("flexdev_upload_files_total", "counter", "Files received for builds.", nil, "slot")
+	appStarts     = newMetric("flexdev_app_starts_total", "counter", "Times the app was started.", nil, "slot")
+	appRestarts   = newMetric("flexdev_app_restarts_total", "counter", "Restarts asked for with `flexdev restart`.", nil, "slot")
+	appExits      = newMetric("flexdev_app_exits_total", "counter", "Times the app exited without being stopped.", nil, "slot")
+)
+
+var metrics []*metric
+
+// metric is a counter or histogram, with a series for each combination of
+// label values.
+type metric struct {
+	name, typ, help string
+	labels          []string
+	buckets         []float64 // Upper bounds, for histograms.
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64  // Counters, and the sum of histograms.
+	counts []uint64 // Per bucket, not cumulative. The last is +Inf.
+	count  uint64
+}
+
+func newMetric(name, typ, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{name: name, typ: typ, help: help, labels: labels, buckets: buckets, series: map[string]*series{}}
+	metrics = append(metrics, m)
+	return m
+}
+
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", m.name, len(values), len(m.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &series{values: values}
+		if m.typ == "histogram" {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to a counter.
+func (m *metric) add(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).value += v
+}
+
+// observe records v in a histogram.
+func (m *metric) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	s.counts[sort.SearchFloat64s(m.buckets, v)]++
+	s.count++
+	s.value += v
+}
+
+// forget drops the series whose label has the given value, e.g. those of a
+// build that is no longer kept.
+func (m *metric) forget(label, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, l := range m.labels {
+		if l != label {
+			continue
+		}
+		for k, s := range m.series {
+			if s.values[i] == value {
+				delete(m.series, k)
+			}
+		}
+	}
+}
+
+func (m *metric) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ != "histogram" {
+			writeSample(w, m.name, m.labels, s.values, s.value)
+			continue
+		}
+		labels := append(m.labels[:len(m.labels):len(m.labels)], "le")
+		var n uint64
+		for i, c := range s.counts {
+			n += c
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = strconv.FormatFloat(m.buckets[i], 'g', -1, 64)
+			}
+			writeSample(w, m.name+"_bucket", labels, append(s.values[:len(s.values):len(s.values)], le), float64(n))
+		}
+		writeSample(w, m.name+"_sum", m.labels, s.values, s.value)
+		writeSample(w, m.name+"_count", m.labels, s.values, float64(s.count))
+	}
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	for i, l := range labels {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(w, `%s%s="%s"`, sep, l, flexdev.EscapeLabel(values[i]))
+	}
+	if len(labels) > 0 {
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func writeGauge(w io.Writer, name, help string, labels []string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(samples))
+	for k := range samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		writeSample(w, name, labels, values, samples[k])
+	}
+}
+
+// forgetBuild drops the metrics of a build that is no longer kept, so that
+// the number of series stays bounded.
+func forgetBuild(id string) {
+	for _, m := range metrics {
+		m.forget("build", id)
+	}
+}
+
+// metricsHandler serves all metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", flexdev.MetricsContentType)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+
+	memory := map[string]float64{}
+	for _, s := range allSlots() {
+		// Builds hold s.mu; a scrape mustn't wait for them.
+		v, _ := s.currentView()
+		if v.pid == 0 {
+			continue
+		}
+		if n, ok := processMemory(v.pid, v.cgroup); ok {
+			memory[s.name+"\xff"+v.build.ID] = float64(n)
+		}
+	}
+	writeGauge(bw, "flexdev_app_memory_bytes", "Memory used by the app: its cgroup's usage, or its resident set size.", []string{"slot", "build"}, memory)
+
+	writeGauge(bw, "flexdev_held_requests", "Requests currently held while a build is in progress.", nil,
+		map[string]float64{"": float64(atomic.LoadInt32(&held))})
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeGauge(bw, "flexdev_server_heap_bytes", "Heap memory in use by the flexdev server.", nil,
+		map[string]float64{"": float64(ms.HeapAlloc)})
+	if n, ok := processMemory(os.Getpid(), ""); ok {
+		writeGauge(bw, "flexdev_server_memory_bytes", "Resident set size of the flexdev server.", nil,
+			map[string]float64{"": float64(n)})
+	}
+	writeGauge(bw, "flexdev_uptime_seconds", "Time since the flexdev server started.", nil,
+		map[string]float64{"": time.Since(serverStart).Seconds()})
+}
+
+var serverStart = time.Now()
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets the proxy take over the connection for upgrades, such as
+// WebSockets.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, rw, err := hijack(w.ResponseWriter)
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return c, rw, err
+}
+
+// hijack takes over the connection of w, for the ResponseWriters wrapping it.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The connection can't be taken over.")
+	}
+	return h.Hijack()
+}
+
+const startTimeout = time.Minute
+
+// timeStart records how long an app started at start took to accept
+// connections.
+func timeStart(slot string, start time.Time, network, addr string) {
+	for time.Since(start) < startTimeout {
+		c, err := net.DialTimeout(network, addr, time.Second)
+		if err == nil {
+			c.Close()
+			deployPhase.observe(time.Since(start).Seconds(), slot, "start")
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
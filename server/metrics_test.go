@@ -0,0 +1,37 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsDuringBuild(t *testing.T) {
+	app := httptest.NewServer(http.NotFoundHandler())
+	defer app.Close()
+	s, done := testSlot(t, "metrics-busy", app, testConfig(t, "runtime: go"))
+	defer done()
+
+	scraped := make(chan string, 1)
+	s.mu.Lock()
+	go func() {
+		w := httptest.NewRecorder()
+		metricsHandler(w, httptest.NewRequest("GET", "/_flexdev/metrics", nil))
+		scraped <- w.Body.String()
+	}()
+	select {
+	case body := <-scraped:
+		if !strings.Contains(body, "flexdev_uptime_seconds") {
+			t.Errorf("metrics missing uptime:\n%s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("metrics waited for the build")
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// redactSettings says what to mask in status, logs and error pages, on top of
+// secret environment variables and common credential formats.
+type redactSettings struct {
+	// Keys are names of environment variables whose values are masked. A
+	// trailing * matches any suffix.
+	Keys []string `yaml:"keys"`
+
+	// Patterns are regular expressions for text to mask. If a pattern has
+	// a group, the text it matches is kept.
+	Patterns []string `yaml:"patterns"`
+
+	patterns []*regexp.Regexp
+}
+
+func (s *redactSettings) parse() error {
+	for _, k := range s.Keys {
+		if i := strings.Index(k, "*"); k == "" || (i >= 0 && i != len(k)-1) {
+			return fmt.Errorf("Bad redact key %q. Only a trailing * is allowed.", k)
+		}
+	}
+	s.patterns = nil
+	for _, p := range s.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("Bad redact pattern %q: %v", p, err)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return nil
+}
+
+// secret reports whether v's value should be masked.
+func (s redactSettings) secret(v flexdev.EnvVar) bool {
+	return v.Secret || flexdev.IsSecretName(v.Name) || matchHeader(s.Keys, v.Name)
+}
+
+const (
+	errorPagePublic = "public"
+	errorPageAdmins = "admins"
+)
+
+// redactor returns a Redactor for output of b.
+func (b *Build) redactor() *flexdev.Redactor {
+	var s redactSettings
+	if b.config != nil {
+		s = b.config.Flexdev.Redact
+	}
+	vars, _ := appEnv(b.slot, b.config)
+	var values []string
+	for _, v := range vars {
+		if s.secret(v) {
+			values = append(values, v.Value)
+		}
+	}
+	return flexdev.NewRedactor(values, s.patterns)
+}
+
+// redactedConfig returns a copy of b's config with secret env_variables
+// masked.
+func (b *Build) redactedConfig() *config {
+	if b.config == nil {
+		return nil
+	}
+	c := *b.config
+	c.Env = make(map[string]string, len(b.config.Env))
+	for k, v := range b.config.Env {
+		if c.Flexdev.Redact.secret(flexdev.EnvVar{Name: k}) {
+			v = flexdev.Redacted
+		}
+		c.Env[k] = v
+	}
+	return &c
+}
+
+// showBuildOutput reports whether r may see v's build output on an error
+// page. With error_page set to admins, only viewers of the server can, as far
+// as a browser can tell who it is.
+func showBuildOutput(r *http.Request, v view) bool {
+	if v.build == nil || v.build.config == nil || v.build.config.Flexdev.ErrorPage != errorPageAdmins {
+		return true
+	}
+	a, ok := auth.(browserAuthenticator)
+	if !ok {
+		return false
+	}
+	id, err := a.authenticateBrowser(r)
+	if err != nil {
+		return false
+	}
+	role, ok, err := serverAccess.roleOf(id)
+	return err == nil && ok && role.Allows(flexdev.RoleViewer)
+}
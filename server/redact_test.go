@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// testAuth sets the server's authenticator and an empty access policy, and
+// returns a function to restore them.
+func testAuth(t *testing.T, a authenticator) func() {
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldAuth, oldAccess := auth, serverAccess
+	auth = a
+	serverAccess = &accessStore{path: filepath.Join(dir, "access.json")}
+	return func() {
+		auth, serverAccess = oldAuth, oldAccess
+		os.RemoveAll(dir)
+	}
+}
+
+func TestShowBuildOutput(t *testing.T) {
+	admins := view{build: &Build{config: testConfig(t, "runtime: go\nflexdev:\n  error_page: admins")}}
+	public := view{build: &Build{config: testConfig(t, "runtime: go")}}
+
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(tokens, []byte("tokA alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := testAuth(t, &tokenAuth{file: tokens})
+	r := httptest.NewRequest("GET", "/", nil)
+	if !showBuildOutput(r, public) {
+		t.Error("public error page hid build output")
+	}
+	if showBuildOutput(r, admins) {
+		t.Error("showed build output without a token")
+	}
+	r.Header.Set("Authorization", "Bearer tokA")
+	if !showBuildOutput(r, admins) {
+		t.Error("hid build output from an owner")
+	}
+	restore()
+
+	secret := []byte("s3cret")
+	defer testAuth(t, newHMACAuth(secret))()
+	body := &countingReader{r: strings.NewReader("form=data")}
+	r = httptest.NewRequest("POST", "/", body)
+	if err := flexdev.SignRequest(r, []byte("form=data"), secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if showBuildOutput(r, admins) {
+		t.Error("hmac auth showed build output")
+	}
+	if body.n != 0 {
+		t.Errorf("read %d bytes of a public request's body", body.n)
+	}
+	if got, _ := ioutil.ReadAll(r.Body); !bytes.Equal(got, []byte("form=data")) {
+		t.Errorf("body = %q after showBuildOutput", got)
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	b := &Build{config: testConfig(t, `runtime: go
+env_variables:
+  PLAIN: visible
+  DB_PASSWORD: hunter22
+  STRIPE: sk_test_abcdef
+flexdev:
+  redact:
+    keys: ["STRI*"]`)}
+
+	c := b.redactedConfig()
+	want := map[string]string{"PLAIN": "visible", "DB_PASSWORD": flexdev.Redacted, "STRIPE": flexdev.Redacted}
+	for k, v := range want {
+		if c.Env[k] != v {
+			t.Errorf("redacted %s = %q, want %q", k, c.Env[k], v)
+		}
+	}
+	if b.config.Env["DB_PASSWORD"] != "hunter22" {
+		t.Error("redactedConfig changed the build's own config")
+	}
+
+	out := b.redactor().Redact("connecting with hunter22 and sk_test_abcdef as visible")
+	if strings.Contains(out, "hunter22") || strings.Contains(out, "sk_test_abcdef") {
+		t.Errorf("secret values left in %q", out)
+	}
+	if !strings.Contains(out, "visible") {
+		t.Errorf("plain value masked in %q", out)
+	}
+}
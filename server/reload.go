@@ -0,0 +1,205 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Larger HTML responses are passed through without the reload script.
+	maxInjectBody = 8 << 20
+
+	// How long to wait for a newly started app to bind its port before
+	// telling browsers to reload.
+	reloadReadyTimeout = 10 * time.Second
+
+	reloadKeepAlive = 15 * time.Second
+)
+
+var reloadScript = template.Must(template.New("reload").Parse(`<script>
+(function() {
+	if (!window.EventSource) return;
+	var es = new EventSource("/_flexdev/reload?slot=" + encodeURIComponent({{.Slot}}) + "&build=" + encodeURIComponent({{.Build}}));
+	es.addEventListener("reload", function() {
+		es.close();
+		location.reload();
+	});
+})();
+</script>
+`))
+
+// injectReload returns a ModifyResponse func for the proxy that adds the live
+// reload script to HTML responses. Gzipped responses are sent on uncompressed;
+// other encodings are left alone.
+func injectReload(v view) func(*http.Response) error {
+	script := &bytes.Buffer{}
+	if err := reloadScript.Execute(script, map[string]string{"Slot": v.slot.name, "Build": v.build.ID}); err != nil {
+		panic(err)
+	}
+
+	return func(resp *http.Response) error {
+		if resp.Request.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		if t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || t != "text/html" {
+			return nil
+		}
+		enc := resp.Header.Get("Content-Encoding")
+		if enc != "" && enc != "identity" && enc != "gzip" {
+			return nil
+		}
+
+		raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxInjectBody+1))
+		if err != nil {
+			return err
+		}
+		if len(raw) > maxInjectBody {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+			return nil
+		}
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+
+		body := raw
+		if enc == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				return nil
+			}
+			body, err = ioutil.ReadAll(io.LimitReader(zr, maxInjectBody+1))
+			if err != nil || len(body) > maxInjectBody {
+				return nil
+			}
+		}
+
+		body = insertBeforeBodyEnd(body, script.Bytes())
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+}
+
+// insertBeforeBodyEnd inserts s before the last </body> tag in html, or at
+// the end if there is none.
+func insertBeforeBodyEnd(html, s []byte) []byte {
+	i := lastIndexFold(html, "</body")
+	if i < 0 {
+		i = len(html)
+	}
+	out := make([]byte, 0, len(html)+len(s))
+	out = append(out, html[:i]...)
+	out = append(out, s...)
+	return append(out, html[i:]...)
+}
+
+// lastIndexFold returns the index of the last instance of the lower case
+// ASCII string tag in b, ignoring ASCII case, or -1. Unlike lowering b first,
+// it keeps indexes into b right whatever b's encoding.
+func lastIndexFold(b []byte, tag string) int {
+	for i := len(b) - len(tag); i >= 0; i-- {
+		j := 0
+		for ; j < len(tag); j++ {
+			c := b[i+j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != tag[j] {
+				break
+			}
+		}
+		if j == len(tag) {
+			return i
+		}
+	}
+	return -1
+}
+
+// reloadHandler sends a server-sent "reload" event whenever an app starts.
+// Browsers pass the build their page came from, so they also reload if they
+// missed a deploy while disconnected. It needs no auth, as the reload script is
+// served to anyone visiting the app.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	v, changed := s.currentView()
+	if v.running() && r.FormValue("build") != "" && r.FormValue("build") != v.build.ID {
+		v.waitListening(r.Context(), time.Now().Add(reloadReadyTimeout))
+		fmt.Fprintf(w, "event: reload\ndata: %s\n\n", v.build.ID)
+		return
+	}
+
+	keepAlive := time.NewTicker(reloadKeepAlive)
+	defer keepAlive.Stop()
+	seen := v // The run the browser's page came from.
+	for {
+		select {
+		case <-changed:
+			v, changed = s.currentView()
+			if !v.running() || (v.build == seen.build && v.starts == seen.starts) {
+				continue
+			}
+			if !waitStarted(r.Context(), v, changed) {
+				// Stopped waiting for a newer view, or the browser went away.
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reload\ndata: %s\n\n", v.build.ID); err != nil {
+				return
+			}
+			flusher.Flush()
+			seen = v
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// waitStarted waits for the app in v to be listening. It reports false if v
+// changes first.
+func waitStarted(ctx context.Context, v view, changed <-chan struct{}) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	v.waitListening(ctx, time.Now().Add(reloadReadyTimeout))
+	return ctx.Err() == nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestInsertBeforeBodyEnd(t *testing.T) {
+	for _, tt := range []struct{ html, want string }{
+		{"<body>hi</body>", "<body>hi<s></body>"},
+		{"<BODY>hi</BODY></html>", "<BODY>hi<s></BODY></html>"},
+		{"<body>a</body><body>b</Body>", "<body>a</body><body>b<s></Body>"},
+		{"no tag", "no tag<s>"},
+		// Latin-1: each \xe9 lowers to a 3 byte replacement character
+		// when taken as UTF-8.
+		{"<body>caf\xe9 \xe9\xe9</body>", "<body>caf\xe9 \xe9\xe9<s></body>"},
+		// Multibyte characters that change length when lowered.
+		{"<body>ȺȺȺ</body>", "<body>ȺȺȺ<s></body>"},
+		{"<body>KK</BODY>", "<body>KK<s></BODY>"},
+	} {
+		if got := string(insertBeforeBodyEnd([]byte(tt.html), []byte("<s>"))); got != tt.want {
+			t.Errorf("insertBeforeBodyEnd(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
+
+func TestProxyInjectsReload(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.FormValue("type"))
+		fmt.Fprint(w, "<html><body>hi</body></html>")
+	}))
+	defer app.Close()
+
+	for _, tt := range []struct {
+		config, typ string
+		inject      bool
+	}{
+		{"runtime: go\nflexdev:\n  live_reload: true", "text/html; charset=utf-8", true},
+		{"runtime: go\nflexdev:\n  live_reload: true", "text/plain", false},
+		{"runtime: go", "text/html", false},
+	} {
+		s, done := testSlot(t, "reload", app, testConfig(t, tt.config))
+		v, _ := s.currentView()
+		w := httptest.NewRecorder()
+		newProxy(v, true).ServeHTTP(w, httptest.NewRequest("GET", "/?type="+url.QueryEscape(tt.typ), nil))
+		done()
+
+		body := w.Body.String()
+		if got := strings.Contains(body, "/_flexdev/reload?slot="); got != tt.inject {
+			t.Errorf("%q with %s: injected = %v, want %v", tt.typ, tt.config, got, tt.inject)
+		}
+		if tt.inject && !strings.HasSuffix(body, "</body></html>") {
+			t.Errorf("script not before </body>: %q", body)
+		}
+		if n := w.Header().Get("Content-Length"); n != "" && n != fmt.Sprint(len(body)) {
+			t.Errorf("Content-Length = %s, body is %d bytes", n, len(body))
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+const (
+	// Requests with larger bodies aren't mirrored.
+	maxShadowBody = 1 << 20
+
+	// How much of each body to keep for a difference.
+	maxShadowDiffBody = 4 << 10
+
+	maxShadowDiffs = 100
+	maxShadowPaths = 500
+
+	shadowTimeout = 30 * time.Second
+)
+
+// shadow mirrors a share of a slot's requests to the app in another slot, and
+// records where their responses differ.
+type shadow struct {
+	to         string
+	percent    float64
+	allMethods bool
+	since      time.Time
+
+	mu       sync.Mutex
+	mirrored int
+	matched  int
+	differed int
+	failed   int
+	paths    map[string]*flexdev.ShadowPath
+	diffs    []flexdev.ShadowDiff
+}
+
+func (s *slot) currentShadow() *shadow {
+	s.shadowMu.Lock()
+	defer s.shadowMu.Unlock()
+	return s.shadow
+}
+
+// sample reports whether r should be mirrored. Unless allMethods is set, only
+// requests that shouldn't change anything are, as the candidate usually
+// shares its backends with the current app.
+func (sh *shadow) sample(r *http.Request) bool {
+	if !sh.allMethods {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			return false
+		}
+	}
+	return rand.Float64()*100 < sh.percent
+}
+
+// shadowBody reads r's body so that it can be sent twice. It reports false if
+// the body is too large, leaving r to be proxied as usual.
+func shadowBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength > maxShadowBody {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxShadowBody+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) > maxShadowBody {
+		return nil, false
+	}
+	return body, true
+}
+
+// mirror serves r with serve, and sends a copy to the candidate app. red
+// masks the current app's secrets in the body kept for a difference.
+func (sh *shadow) mirror(w http.ResponseWriter, r *http.Request, body []byte, red *flexdev.Redactor, serve func(http.ResponseWriter, *http.Request)) {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	cr := r.WithContext(ctx)
+	u := *r.URL
+	cr.URL = &u
+	cr.Header = cloneHeader(r.Header)
+	cr.Body = ioutil.NopCloser(bytes.NewReader(body))
+	cr.ContentLength = int64(len(body))
+
+	candidate := make(chan *shadowWriter, 1)
+	go func() {
+		defer cancel()
+		cw := newShadowWriter(nil, nil)
+		if err := sh.serveCandidate(cw, cr); err != nil {
+			cw.err = err
+		}
+		candidate <- cw
+	}()
+
+	pw := newShadowWriter(w, red)
+	serve(pw, r)
+	// Don't hold the live response for the candidate.
+	go func() { sh.record(r, pw, <-candidate) }()
+}
+
+func (sh *shadow) serveCandidate(w *shadowWriter, r *http.Request) error {
+	s, err := getSlot(sh.to, false)
+	if err != nil {
+		return err
+	}
+	v, _ := s.currentView()
+	if !v.running() {
+		return fmt.Errorf("Candidate in slot %s is not running.", sh.to)
+	}
+	w.red = v.build.redactor()
+	p := newProxy(v, false)
+	var proxyErr error
+	p.Transport = errorTransport{v.transport, &proxyErr}
+	p.ServeHTTP(w, r)
+	return proxyErr
+}
+
+// errorTransport records the error of a failed round trip, which the proxy
+// otherwise only logs.
+type errorTransport struct {
+	rt  http.RoundTripper
+	err *error
+}
+
+func (t errorTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt := t.rt
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(r)
+	if err != nil {
+		*t.err = fmt.Errorf("Could not reach candidate: %v", err)
+	}
+	return resp, err
+}
+
+func (sh *shadow) record(r *http.Request, primary, candidate *shadowWriter) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	key := r.Method + " " + r.URL.Path
+	p := sh.paths[key]
+	if p == nil {
+		if len(sh.paths) >= maxShadowPaths {
+			key = "(other)"
+			p = sh.paths[key]
+		}
+		if p == nil {
+			p = &flexdev.ShadowPath{Method: r.Method, Path: r.URL.Path}
+			if key == "(other)" {
+				p.Method, p.Path = "", key
+			}
+			sh.paths[key] = p
+		}
+	}
+
+	sh.mirrored++
+	p.Mirrored++
+	switch {
+	case candidate.err != nil:
+		sh.failed++
+		p.Failed++
+	case primary.code() == candidate.code() && bytes.Equal(primary.hash.Sum(nil), candidate.hash.Sum(nil)):
+		sh.matched++
+		return
+	default:
+		sh.differed++
+		p.Differed++
+	}
+
+	d := flexdev.ShadowDiff{
+		Time:              time.Now(),
+		Method:            r.Method,
+		URL:               r.URL.RequestURI(),
+		Status:            primary.code(),
+		CandidateStatus:   candidate.code(),
+		BodySize:          primary.size,
+		CandidateBodySize: candidate.size,
+		Body:              primary.keptBody(),
+		CandidateBody:     candidate.keptBody(),
+	}
+	if candidate.err != nil {
+		d.Error = candidate.err.Error()
+	}
+	sh.diffs = append(sh.diffs, d)
+	if len(sh.diffs) > maxShadowDiffs {
+		sh.diffs = append([]flexdev.ShadowDiff(nil), sh.diffs[len(sh.diffs)-maxShadowDiffs:]...)
+	}
+}
+
+func (sh *shadow) report(from string) *flexdev.ShadowReport {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	rep := &flexdev.ShadowReport{
+		From:       from,
+		To:         sh.to,
+		Percent:    sh.percent,
+		AllMethods: sh.allMethods,
+		Since:      sh.since,
+		Mirrored:   sh.mirrored,
+		Matched:    sh.matched,
+		Differed:   sh.differed,
+		Failed:     sh.failed,
+		Diffs:      append([]flexdev.ShadowDiff(nil), sh.diffs...),
+	}
+	for _, p := range sh.paths {
+		rep.Paths = append(rep.Paths, *p)
+	}
+	sort.Slice(rep.Paths, func(i, j int) bool {
+		a, b := rep.Paths[i], rep.Paths[j]
+		if a.Differed+a.Failed != b.Differed+b.Failed {
+			return a.Differed+a.Failed > b.Differed+b.Failed
+		}
+		return a.Method+" "+a.Path < b.Method+" "+b.Path
+	})
+	return rep
+}
+
+// shadowWriter hashes the body written to it, and keeps its start. If it
+// wraps a ResponseWriter, it passes everything on; otherwise it discards it.
+type shadowWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	size   int64
+	hash   hash.Hash
+	body   bytes.Buffer
+	red    *flexdev.Redactor // Masks secrets in body, as viewers see it.
+	err    error
+}
+
+func newShadowWriter(w http.ResponseWriter, red *flexdev.Redactor) *shadowWriter {
+	return &shadowWriter{w: w, header: http.Header{}, hash: sha1.New(), red: red}
+}
+
+// keptBody returns the start of the body, with secrets masked.
+func (w *shadowWriter) keptBody() []byte {
+	red := w.red
+	if red == nil {
+		red = (&Build{}).redactor()
+	}
+	return redactBody(red, w.body.Bytes())
+}
+
+func (w *shadowWriter) Header() http.Header {
+	if w.w != nil {
+		return w.w.Header()
+	}
+	return w.header
+}
+
+func (w *shadowWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	if w.w != nil {
+		w.w.WriteHeader(code)
+	}
+}
+
+func (w *shadowWriter) Write(b []byte) (int, error) {
+	w.size += int64(len(b))
+	w.hash.Write(b)
+	if rest := maxShadowDiffBody - w.body.Len(); rest > 0 {
+		if len(b) < rest {
+			rest = len(b)
+		}
+		w.body.Write(b[:rest])
+	}
+	if w.w != nil {
+		return w.w.Write(b)
+	}
+	return len(b), nil
+}
+
+func (w *shadowWriter) Flush() {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *shadowWriter) Unwrap() http.ResponseWriter {
+	return w.w
+}
+
+// Hijack passes on the connection of the wrapped ResponseWriter. A candidate's
+// response has no connection to take over.
+func (w *shadowWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.w == nil {
+		return nil, nil, errors.New("The shadow request has no connection to take over.")
+	}
+	c, rw, err := hijack(w.w)
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return c, rw, err
+}
+
+func (w *shadowWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func shadowStartHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusNotFound, Error: err}.WriteTo(w)
+		return
+	}
+	to := r.FormValue("to")
+	if to == "" {
+		Response{Code: http.StatusBadRequest, Error: errors.New("Missing candidate slot.")}.WriteTo(w)
+		return
+	}
+	if _, err := getSlot(to, false); err != nil {
+		Response{Code: http.StatusBadRequest, Error: err}.WriteTo(w)
+		return
+	}
+	if to == s.name {
+		Response{Code: http.StatusBadRequest, Error: errors.New("Can't mirror requests to the same slot.")}.WriteTo(w)
+		return
+	}
+	percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Bad percentage %q. Must be more than 0 and at most 100.", r.FormValue("percent"))}.WriteTo(w)
+		return
+	}
+
+	sh := &shadow{
+		to:         to,
+		percent:    percent,
+		allMethods: r.FormValue("all_methods") != "",
+		since:      time.Now(),
+		paths:      map[string]*flexdev.ShadowPath{},
+	}
+	s.shadowMu.Lock()
+	s.shadow = sh
+	s.shadowMu.Unlock()
+	audit(r, flexdev.AuditEvent{Action: "shadow.start", Slot: s.name, Details: fmt.Sprintf("to=%s percent=%v", to, percent)})
+
+	Response{
+		Message: fmt.Sprintf("Mirroring %v%% of requests to slot %s to slot %s.", percent, s.name, to),
+		Shadow:  sh.report(s.name),
+	}.WriteTo(w)
+}
+
+func shadowStopHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusNotFound, Error: err}.WriteTo(w)
+		return
+	}
+	s.shadowMu.Lock()
+	sh := s.shadow
+	s.shadow = nil
+	s.shadowMu.Unlock()
+	if sh == nil {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Slot %s isn't mirroring requests.", s.name)}.WriteTo(w)
+		return
+	}
+	audit(r, flexdev.AuditEvent{Action: "shadow.stop", Slot: s.name, Details: "to=" + sh.to})
+	Response{Message: "Stopped mirroring requests.", Shadow: sh.report(s.name)}.WriteTo(w)
+}
+
+func shadowReportHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := slotParam(r, false)
+	if err != nil {
+		Response{Code: http.StatusNotFound, Error: err}.WriteTo(w)
+		return
+	}
+	sh := s.currentShadow()
+	if sh == nil {
+		Response{Code: http.StatusBadRequest, Error: fmt.Errorf("Slot %s isn't mirroring requests. Use `flexdev shadow start` first.", s.name)}.WriteTo(w)
+		return
+	}
+	Response{Shadow: sh.report(s.name)}.WriteTo(w)
+}
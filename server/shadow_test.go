@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+func TestMirrorDoesNotWaitForCandidate(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "candidate")
+	}))
+	defer slow.Close()
+	defer close(release)
+	_, done := testSlot(t, "shadow-slow", slow, testConfig(t, "runtime: go"))
+	defer done()
+
+	sh := &shadow{to: "shadow-slow", percent: 100, paths: map[string]*flexdev.ShadowPath{}}
+	r := httptest.NewRequest("GET", "/x", nil)
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		sh.mirror(w, r, nil, nil, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "primary")
+		})
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror waited for the candidate")
+	}
+	if want, got := "primary", w.Body.String(); want != got {
+		t.Errorf("want body %q, got %q", want, got)
+	}
+
+	release <- struct{}{}
+	for i := 0; sh.report("").Mirrored == 0; i++ {
+		if i == 500 {
+			t.Fatal("candidate response was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, got := 1, sh.report("").Differed; want != got {
+		t.Errorf("want %d differed, got %d", want, got)
+	}
+}
+
+func TestShadowDiffRedactsBodies(t *testing.T) {
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "candidate hunter22-candidate")
+	}))
+	defer candidate.Close()
+	_, done := testSlot(t, "shadow-secret", candidate, testConfig(t, "runtime: go\nenv_variables:\n  DB_PASSWORD: hunter22-candidate"))
+	defer done()
+	primary := httptest.NewServer(http.NotFoundHandler())
+	defer primary.Close()
+	s, done := testSlot(t, "shadow-primary", primary, testConfig(t, "runtime: go\nenv_variables:\n  DB_PASSWORD: hunter22-primary"))
+	defer done()
+
+	sh := &shadow{to: "shadow-secret", percent: 100, paths: map[string]*flexdev.ShadowPath{}}
+	sh.mirror(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil), nil, s.build.redactor(), func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary hunter22-primary")
+	})
+	for i := 0; sh.report("").Mirrored == 0; i++ {
+		if i == 500 {
+			t.Fatal("candidate response was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	diffs := sh.report("").Diffs
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1", len(diffs))
+	}
+	if want, got := "primary "+flexdev.Redacted, string(diffs[0].Body); want != got {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if want, got := "candidate "+flexdev.Redacted, string(diffs[0].CandidateBody); want != got {
+		t.Errorf("candidate body = %q, want %q", got, want)
+	}
+}
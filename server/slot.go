@@ -0,0 +1,221 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// How many builds to keep around in each slot, including the current one, so
+// that logs of previous builds can still be read.
+const keepBuilds = 5
+
+// A slot holds one app: its build directory, current build and process, and
+// the logs of recent builds. Slots let several developers share a server
+// without overwriting each other's builds.
+type slot struct {
+	name string
+	dir  string
+
+	// mu guards build and builds. It is held for as long as a build takes,
+	// so the proxy uses views instead.
+	mu     sync.RWMutex
+	build  *Build
+	builds []*Build // Most recent builds, oldest first.
+
+	viewMu  sync.Mutex
+	view    view
+	changed chan struct{}
+
+	shadowMu sync.Mutex
+	shadow   *shadow // Where to mirror requests to, if anywhere.
+}
+
+var (
+	slotsMu sync.Mutex
+	slots   = map[string]*slot{}
+)
+
+func init() {
+	slots[flexdev.DefaultSlot] = newSlot(flexdev.DefaultSlot)
+}
+
+// slotsDir holds the builds of slots other than the default one.
+var slotsDir = filepath.Join(os.TempDir(), "flexdev-slots")
+
+// runDir holds the slots' unix sockets.
+var runDir = filepath.Join(os.TempDir(), "flexdev-run")
+
+func newSlot(name string) *slot {
+	dir := packageDir
+	if name != flexdev.DefaultSlot {
+		// The binary is named after the directory.
+		dir = filepath.Join(slotsDir, name, "flexdev-server")
+	}
+	s := &slot{name: name, dir: dir, changed: make(chan struct{})}
+	s.view.slot = s
+	return s
+}
+
+// getSlot returns the named slot, or the default slot if name is empty. It
+// creates the slot if create is set.
+func getSlot(name string, create bool) (*slot, error) {
+	if name == "" {
+		name = flexdev.DefaultSlot
+	}
+	if err := flexdev.CheckSlotName(name); err != nil {
+		return nil, err
+	}
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	s := slots[name]
+	if s == nil {
+		if !create {
+			return nil, fmt.Errorf("No slot %q. Deploy to it with `flexdev deploy -slot=%s`.", name, name)
+		}
+		s = newSlot(name)
+		slots[name] = s
+	}
+	return s, nil
+}
+
+// slotParam returns the slot named by the request's slot query parameter.
+// It doesn't use FormValue, which would consume form-encoded bodies.
+func slotParam(r *http.Request, create bool) (*slot, error) {
+	return getSlot(r.URL.Query().Get("slot"), create)
+}
+
+// allSlots returns all slots, sorted by name.
+func allSlots() []*slot {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	l := make([]*slot, 0, len(slots))
+	for _, s := range slots {
+		l = append(l, s)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].name < l[j].name })
+	return l
+}
+
+// prefixKey is the context key of the path prefix routeSlot removed, which
+// the proxy passes on in X-Forwarded-Prefix.
+type prefixKey struct{}
+
+// routeSlot picks the slot for a proxied request: the one named by the slot
+// header, by a /_slot/NAME/ path prefix (which is removed), or by the first
+// label of the host name. Anything else goes to the default slot.
+func routeSlot(r *http.Request) (*slot, *http.Request, error) {
+	if name := r.Header.Get(flexdev.SlotHeader); name != "" {
+		s, err := getSlot(name, false)
+		return s, r, err
+	}
+	if strings.HasPrefix(r.URL.Path, "/_slot/") {
+		name := strings.TrimPrefix(r.URL.Path, "/_slot/")
+		rest := "/"
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, rest = name[:i], name[i:]
+		}
+		s, err := getSlot(name, false)
+		if err != nil {
+			return nil, r, err
+		}
+		r2 := r.WithContext(context.WithValue(r.Context(), prefixKey{}, "/_slot/"+name))
+		u := *r.URL
+		u.Path, u.RawPath = rest, ""
+		r2.URL = &u
+		return s, r2, nil
+	}
+	// e.g. alice-dot-flexdev-dot-project.appspot.com or alice.dev.example.com.
+	label := r.Host
+	if i := strings.IndexAny(label, ".:"); i >= 0 {
+		label = label[:i]
+	}
+	if i := strings.Index(label, "-dot-"); i >= 0 {
+		label = label[:i]
+	}
+	if label != flexdev.DefaultSlot && flexdev.CheckSlotName(label) == nil {
+		slotsMu.Lock()
+		s := slots[label]
+		slotsMu.Unlock()
+		if s != nil {
+			return s, r, nil
+		}
+	}
+	s, err := getSlot("", false)
+	return s, r, err
+}
+
+// cgroupName names the cgroup the slot's app runs in.
+func (s *slot) cgroupName() string {
+	if s.name == flexdev.DefaultSlot {
+		return "flexdev-app"
+	}
+	return "flexdev-app-" + s.name
+}
+
+func (s *slot) addBuild(b *Build) {
+	s.builds = append(s.builds, b)
+	if len(s.builds) > keepBuilds {
+		for _, old := range s.builds[:len(s.builds)-keepBuilds] {
+			forgetBuild(old.ID)
+		}
+		s.builds = append([]*Build(nil), s.builds[len(s.builds)-keepBuilds:]...)
+	}
+}
+
+// findBuild returns the build with the given ID, or the current build if id
+// is empty.
+func (v view) findBuild(id string) *Build {
+	if id == "" {
+		return v.build
+	}
+	for _, b := range v.builds {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// publish updates the proxy's view of the current build. Must be called with
+// s.mu held, after changing the current build or its state.
+func (s *slot) publish() {
+	v := view{slot: s, build: s.build, builds: append([]*Build(nil), s.builds...)}
+	if b := s.build; b != nil {
+		v.state = string(b.State)
+		v.addr = b.addr
+		v.transport = b.transport
+		v.starts = b.starts
+		v.manifest = b.manifest
+		v.cgroup = b.cgroup
+		if b.State == flexdev.StateRunning && b.cmd != nil && b.cmd.Process != nil {
+			v.pid = b.cmd.Process.Pid
+		}
+		v.ownPort = b.config.Flexdev.Listener == listenerPort
+	}
+
+	s.viewMu.Lock()
+	defer s.viewMu.Unlock()
+	s.view = v
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// currentView returns the current view, and a channel that is closed when it
+// next changes.
+func (s *slot) currentView() (view, <-chan struct{}) {
+	s.viewMu.Lock()
+	defer s.viewMu.Unlock()
+	return s.view, s.changed
+}
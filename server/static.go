@@ -0,0 +1,168 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// handler is an entry of app.yaml's handlers section. flexdev serves static
+// handlers from the build directory itself; requests matching any other
+// handler, or none, go to the app.
+type handler struct {
+	URL         string            `yaml:"url"`
+	StaticDir   string            `yaml:"static_dir"`
+	StaticFiles string            `yaml:"static_files"`
+	Upload      string            `yaml:"upload"`
+	MimeType    string            `yaml:"mime_type"`
+	Expiration  string            `yaml:"expiration"`
+	HTTPHeaders map[string]string `yaml:"http_headers"`
+
+	url        *regexp.Regexp
+	upload     *regexp.Regexp
+	files      string // StaticFiles, with \1 turned into ${1}.
+	expiration time.Duration
+	expires    bool
+}
+
+var backref = regexp.MustCompile(`\\(\d)`)
+
+func (c *config) parseHandlers() error {
+	var defaultExpiration time.Duration
+	if c.DefaultExpiration != "" {
+		d, err := flexdev.ParseExpiration(c.DefaultExpiration)
+		if err != nil {
+			return fmt.Errorf("Bad default_expiration: %v", err)
+		}
+		defaultExpiration = d
+	}
+
+	for i := range c.Handlers {
+		h := &c.Handlers[i]
+		if h.URL == "" {
+			return fmt.Errorf("Handler %d has no url.", i+1)
+		}
+		if h.StaticDir != "" && h.StaticFiles != "" {
+			return fmt.Errorf("Handler %s has both static_dir and static_files.", h.URL)
+		}
+		for _, p := range []string{h.StaticDir, h.StaticFiles} {
+			if path.IsAbs(p) || filepath.IsAbs(p) {
+				return fmt.Errorf("Handler %s: static path %q must be relative to the app.", h.URL, p)
+			}
+		}
+
+		pattern := "^(?:" + h.URL + ")$"
+		if h.StaticDir != "" {
+			// static_dir urls are plain prefixes.
+			pattern = "^" + regexp.QuoteMeta(strings.TrimSuffix(h.URL, "/")) + "/"
+		}
+		var err error
+		if h.url, err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("Handler %s: bad url: %v", h.URL, err)
+		}
+		if h.Upload != "" {
+			if h.upload, err = regexp.Compile("^(?:" + h.Upload + ")$"); err != nil {
+				return fmt.Errorf("Handler %s: bad upload: %v", h.URL, err)
+			}
+		}
+		h.files = backref.ReplaceAllString(strings.Replace(h.StaticFiles, "$", "$$", -1), "$${$1}")
+
+		h.expiration, h.expires = defaultExpiration, c.DefaultExpiration != ""
+		if h.Expiration != "" {
+			d, err := flexdev.ParseExpiration(h.Expiration)
+			if err != nil {
+				return fmt.Errorf("Handler %s: bad expiration: %v", h.URL, err)
+			}
+			h.expiration, h.expires = d, true
+		}
+	}
+	return nil
+}
+
+// match returns the file that h maps p to, relative to the app. It returns
+// "" if h matches p but isn't a static handler.
+func (h *handler) match(p string) (file string, ok bool) {
+	m := h.url.FindStringSubmatchIndex(p)
+	if m == nil {
+		return "", false
+	}
+	switch {
+	case h.StaticDir != "":
+		return path.Join(h.StaticDir, p[m[1]:]), true
+	case h.StaticFiles != "":
+		return string(h.url.ExpandString(nil, h.files, p, m)), true
+	}
+	return "", true
+}
+
+// serveStatic serves r from the build directory if it matches a static
+// handler, and reports whether it did.
+func serveStatic(w http.ResponseWriter, r *http.Request, v view) bool {
+	if v.build == nil {
+		return false
+	}
+	for i := range v.build.config.Handlers {
+		h := &v.build.config.Handlers[i]
+		file, ok := h.match(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if file == "" {
+			return false
+		}
+		w.Header().Set("X-FlexDev", flexdev.Version)
+		h.serve(w, r, v.build.dir, file)
+		return true
+	}
+	return false
+}
+
+func (h *handler) serve(w http.ResponseWriter, r *http.Request, dir, file string) {
+	file = path.Clean("/" + file)[1:]
+	if (h.upload != nil && !h.upload.MatchString(file)) || reservedPath(file) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if h.MimeType != "" {
+		w.Header().Set("Content-Type", h.MimeType)
+	}
+	if h.expires {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(h.expiration/time.Second)))
+		w.Header().Set("Expires", time.Now().Add(h.expiration).UTC().Format(http.TimeFormat))
+	}
+	for k, v := range h.HTTPHeaders {
+		w.Header().Set(k, v)
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// reservedPath reports whether file, relative to the build directory, belongs
+// to the server rather than the app.
+func reservedPath(file string) bool {
+	_, ok := flexdev.ReservedPath(file)
+	return file == "" || ok
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticReservedPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexdev-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"index.html", "flexdev-server", "_gopath/pkg/x.a"} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := testConfig(t, "runtime: go\nhandlers:\n- url: /\n  static_dir: .")
+	v := view{build: &Build{dir: dir, config: c}}
+
+	for path, want := range map[string]int{
+		"/index.html":      http.StatusOK,
+		"/flexdev-server":  http.StatusNotFound,
+		"/_gopath/pkg/x.a": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		if !serveStatic(w, httptest.NewRequest("GET", path, nil), v) {
+			t.Errorf("%s: not served statically", path)
+			continue
+		}
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// uploadLimits cap what deploys may upload. See newUploadLimits.
+var uploadLimits flexdev.UploadLimits
+
+// uploadSlots holds a token for each file being uploaded, if there is a
+// limit on concurrent uploads.
+var uploadSlots chan struct{}
+
+// Admin API requests other than create and put are small.
+const maxAdminBody = 1 << 20
+
+// newUploadLimits returns the upload limits set in the environment, or the
+// defaults. 0 means no limit.
+//
+//	FLEXDEV_MAX_FILE_SIZE   Bytes in one file, e.g. 64M (default 256M).
+//	FLEXDEV_MAX_BUILD_SIZE  Bytes in all of a build's files (default 2G).
+//	FLEXDEV_MAX_FILES       Files in a build (default 20000).
+//	FLEXDEV_MAX_UPLOADS     Files being uploaded at once (default 32).
+func newUploadLimits() (flexdev.UploadLimits, error) {
+	l := flexdev.UploadLimits{
+		MaxFileSize:  256 << 20,
+		MaxBuildSize: 2 << 30,
+		MaxFiles:     20000,
+		MaxUploads:   32,
+	}
+	for _, s := range []struct {
+		env  string
+		size *int64
+	}{
+		{"FLEXDEV_MAX_FILE_SIZE", &l.MaxFileSize},
+		{"FLEXDEV_MAX_BUILD_SIZE", &l.MaxBuildSize},
+	} {
+		if v := os.Getenv(s.env); v != "" {
+			n, err := flexdev.ParseSize(v)
+			if err != nil {
+				return l, fmt.Errorf("Bad %s: %v", s.env, err)
+			}
+			*s.size = n
+		}
+	}
+	for _, c := range []struct {
+		env string
+		n   *int
+	}{
+		{"FLEXDEV_MAX_FILES", &l.MaxFiles},
+		{"FLEXDEV_MAX_UPLOADS", &l.MaxUploads},
+	} {
+		if v := os.Getenv(c.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return l, fmt.Errorf("Bad %s %q.", c.env, v)
+			}
+			*c.n = n
+		}
+	}
+	return l, nil
+}
+
+// maxBodySize returns how many bytes an admin request to path may send, or
+// -1 for no limit. The body is limited before authentication, which may read
+// it all.
+func maxBodySize(path string) int64 {
+	switch path {
+	case "/_flexdev/build/put":
+		if uploadLimits.MaxFileSize == 0 {
+			return -1
+		}
+		return uploadLimits.MaxFileSize
+	case "/_flexdev/build/create":
+		if uploadLimits.MaxFiles == 0 {
+			return -1
+		}
+		// The config, and a generous allowance for each file's entry.
+		return maxAdminBody + int64(uploadLimits.MaxFiles)*4096
+	}
+	return maxAdminBody
+}
+
+// errBodyTooLarge is what http.MaxBytesReader fails with.
+const errBodyTooLarge = "http: request body too large"
+
+// acquireUpload takes an upload slot, and reports whether there was one free.
+func acquireUpload() bool {
+	if uploadSlots == nil {
+		return true
+	}
+	select {
+	case uploadSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseUpload() {
+	if uploadSlots != nil {
+		<-uploadSlots
+	}
+}
+
+// Errors returned by writeUpload for files that aren't what was declared.
+var (
+	errTooLarge    = errors.New("larger than declared")
+	errSumMismatch = errors.New("sum did not match")
+)
+
+// writeUpload streams r, which should have size bytes with the given SHA1,
+// to path. Nothing is written to path unless it does.
+func writeUpload(path string, r io.Reader, size int64, sum string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".flexdev-upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, size+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if n > size {
+		return n, errTooLarge
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != sum {
+		return n, errSumMismatch
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+func uploadLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	l := uploadLimits
+	Response{UploadLimits: &l}.WriteTo(w)
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// doShadow mirrors a share of one slot's requests to a candidate build in
+// another slot, and reports where their responses differ.
+func doShadow() error {
+	action := flag.Arg(1)
+	flags := flag.NewFlagSet("shadow "+action, flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	slot := flags.String("slot", "", "Slot whose requests to mirror. Defaults to the default slot.")
+	to := flags.String("to", "", "Slot of the candidate build to mirror requests to. Only for 'shadow start'.")
+	percent := flags.Float64("percent", 10, "Percentage of requests to mirror. Only for 'shadow start'.")
+	allMethods := flags.Bool("all-methods", false, "Mirror all requests, not just GET, HEAD and OPTIONS. Only for 'shadow start'.")
+	verbose := flags.Bool("v", false, "Show the most recent differences, with the start of both bodies.")
+	if len(flag.Args()) < 2 {
+		usage("Missing shadow command.")
+	}
+	if err := flags.Parse(flag.Args()[2:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	v := url.Values{"slot": {*slot}}
+	switch action {
+	case "start":
+		if *to == "" {
+			usage("Missing 'to' flag.")
+		}
+		v.Set("to", *to)
+		v.Set("percent", strconv.FormatFloat(*percent, 'f', -1, 64))
+		if *allMethods {
+			v.Set("all_methods", "1")
+		}
+	case "stop", "report":
+	default:
+		usage("Unknown shadow command.")
+	}
+
+	req, err := http.NewRequest("POST", *target+"/_flexdev/shadow/"+action+"?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doReq(req)
+	if err != nil {
+		return err
+	}
+	if action != "start" && resp.Shadow != nil {
+		printShadowReport(resp.Shadow, *verbose)
+	}
+	return nil
+}
+
+func printShadowReport(r *flexdev.ShadowReport, verbose bool) {
+	fmt.Printf("Mirroring %v%% of requests from slot %s to slot %s since %s.\n", r.Percent, r.From, r.To, r.Since.Local().Format(time.Stamp))
+	fmt.Printf("%d mirrored, %d matched, %d differed, %d failed.\n\n", r.Mirrored, r.Matched, r.Differed, r.Failed)
+	if len(r.Paths) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "METHOD\tPATH\tMIRRORED\tDIFFERED\tFAILED")
+		for _, p := range r.Paths {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", p.Method, p.Path, p.Mirrored, p.Differed, p.Failed)
+		}
+		tw.Flush()
+	}
+	if !verbose {
+		return
+	}
+	for _, d := range r.Diffs {
+		fmt.Printf("\n%s %s %s\n", d.Time.Local().Format("15:04:05"), d.Method, d.URL)
+		if d.Error != "" {
+			fmt.Printf("  candidate failed: %s\n", d.Error)
+			continue
+		}
+		fmt.Printf("  current:   %d %s, %d bytes\n", d.Status, http.StatusText(d.Status), d.BodySize)
+		fmt.Printf("  candidate: %d %s, %d bytes\n", d.CandidateStatus, http.StatusText(d.CandidateStatus), d.CandidateBodySize)
+		fmt.Printf("--- current\n%s\n--- candidate\n%s\n", d.Body, d.CandidateBody)
+	}
+}
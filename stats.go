@@ -0,0 +1,228 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/broady/flexdev/lib/flexdev"
+)
+
+// doStats summarizes the server's metrics: where deploy time goes, how the
+// app is doing, and how requests through the proxy are served.
+func doStats() error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.Usage = func() {
+		flag.Usage()
+		flags.PrintDefaults()
+	}
+	target := flags.String("target", "", "Hostname of flexdev server. Required.")
+	slot := flags.String("slot", "", "Only show this slot. Defaults to all slots.")
+	if err := flags.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+	if *target == "" {
+		usage("Missing 'target' flag.")
+	}
+
+	req, err := http.NewRequest("GET", *target+"/_flexdev/metrics", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != flexdev.MetricsContentType {
+		_, err := readResponse(resp)
+		return err
+	}
+	metrics, err := flexdev.ParseMetrics(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Could not read metrics: %v", err)
+	}
+
+	st := stats{}
+	for _, m := range metrics {
+		if *slot != "" && m.Labels["slot"] != "" && m.Labels["slot"] != *slot {
+			continue
+		}
+		st[m.Name] = append(st[m.Name], m)
+	}
+	st.print()
+	return nil
+}
+
+// stats are metric samples by name.
+type stats map[string][]flexdev.Metric
+
+// sum adds up the samples of name whose labels match the given ones.
+func (st stats) sum(name string, labels ...string) float64 {
+	var n float64
+	for _, m := range st.match(name, labels...) {
+		n += m.Value
+	}
+	return n
+}
+
+// match returns the samples of name with the given label name/value pairs.
+func (st stats) match(name string, labels ...string) []flexdev.Metric {
+	var l []flexdev.Metric
+outer:
+	for _, m := range st[name] {
+		for i := 0; i+1 < len(labels); i += 2 {
+			if m.Labels[labels[i]] != labels[i+1] {
+				continue outer
+			}
+		}
+		l = append(l, m)
+	}
+	return l
+}
+
+// values returns the distinct values of label among the samples of name.
+func (st stats) values(name, label string) []string {
+	seen := map[string]bool{}
+	var l []string
+	for _, m := range st[name] {
+		if v, ok := m.Labels[label]; ok && !seen[v] {
+			seen[v] = true
+			l = append(l, v)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (st stats) print() {
+	fmt.Println("Deploys, with average time per phase:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLOT\tBUILDS\tUPLOAD\tBUILD\tSTART\tUPLOADED")
+	phase := "flexdev_deploy_phase_duration_seconds"
+	for _, slot := range st.slots() {
+		avg := func(p string) string {
+			n := st.sum(phase+"_count", "slot", slot, "phase", p)
+			if n == 0 {
+				return "-"
+			}
+			return formatSeconds(st.sum(phase+"_sum", "slot", slot, "phase", p) / n)
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%s\t%s\t%s\t%s in %.0f files\n", slot,
+			st.sum(phase+"_count", "slot", slot, "phase", "build"),
+			avg("upload"), avg("build"), avg("start"),
+			formatBytes(st.sum("flexdev_upload_bytes_total", "slot", slot)),
+			st.sum("flexdev_upload_files_total", "slot", slot))
+	}
+	tw.Flush()
+
+	fmt.Println("\nApps:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLOT\tSTARTS\tRESTARTS\tEXITS\tMEMORY")
+	for _, slot := range st.slots() {
+		memory := "-"
+		if l := st.match("flexdev_app_memory_bytes", "slot", slot); len(l) > 0 {
+			memory = formatBytes(l[0].Value)
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%.0f\t%.0f\t%s\n", slot,
+			st.sum("flexdev_app_starts_total", "slot", slot),
+			st.sum("flexdev_app_restarts_total", "slot", slot),
+			st.sum("flexdev_app_exits_total", "slot", slot),
+			memory)
+	}
+	tw.Flush()
+
+	fmt.Println("\nRequests through the proxy:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLOT\tBUILD\tREQUESTS\t2XX\t3XX\t4XX\t5XX\tP50\tP95\tP99")
+	latency := "flexdev_proxy_request_duration_seconds"
+	for _, slot := range st.slots() {
+		for _, build := range st.values("flexdev_proxy_requests_total", "build") {
+			reqs := st.match("flexdev_proxy_requests_total", "slot", slot, "build", build)
+			if len(reqs) == 0 {
+				continue
+			}
+			var total float64
+			var classes [6]float64
+			for _, m := range reqs {
+				total += m.Value
+				if c := m.Labels["code"]; len(c) == 3 && c[0] >= '1' && c[0] <= '5' {
+					classes[c[0]-'0'] += m.Value
+				}
+			}
+			buckets := st.match(latency+"_bucket", "slot", slot, "build", build)
+			q := func(q float64) string {
+				v := flexdev.HistogramQuantile(q, buckets)
+				if math.IsNaN(v) {
+					return "-"
+				}
+				return formatSeconds(v)
+			}
+			if build == "" {
+				build = "(none)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\t%s\t%s\t%s\n", slot, build, total,
+				classes[2], classes[3], classes[4], classes[5], q(0.5), q(0.95), q(0.99))
+		}
+	}
+	tw.Flush()
+
+	fmt.Println()
+	if l := st["flexdev_server_memory_bytes"]; len(l) > 0 {
+		fmt.Printf("Server memory: %s.", formatBytes(l[0].Value))
+	}
+	if l := st["flexdev_uptime_seconds"]; len(l) > 0 {
+		fmt.Printf(" Up for %s.", time.Duration(l[0].Value*float64(time.Second)).Round(time.Second))
+	}
+	fmt.Println()
+}
+
+// slots returns the slots that any metric mentions.
+func (st stats) slots() []string {
+	seen := map[string]bool{}
+	var l []string
+	for name := range st {
+		for _, v := range st.values(name, "slot") {
+			if !seen[v] {
+				seen[v] = true
+				l = append(l, v)
+			}
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+func formatSeconds(s float64) string {
+	d := time.Duration(s * float64(time.Second))
+	switch {
+	case d >= time.Second:
+		return d.Round(100 * time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(100 * time.Microsecond).String()
+	}
+	return d.String()
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", n), ".0") + units[i]
+}